@@ -5,90 +5,255 @@ import (
 	"fmt"
 	"os"
 	"regexp"
-	"runtime"
 	"strings"
 
-	"github.com/jattle/go-instrumentation/instrument/filter"
-	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/instrument"
+	"github.com/jattle/go-instrumentation/instrument/config"
 	"github.com/jattle/go-instrumentation/instrument/rewriter"
+	"github.com/jattle/go-instrumentation/internal/diff"
 )
 
 var (
-	source          = flag.String("source", "", "go source file to instrument")
-	output          = flag.String("output", "", "output file to store instrumentation result")
+	source          = flag.String("source", "", "go source file, dir or package pattern like ./... separated by ,")
+	output          = flag.String("output", "", "output file or dir to store instrumentation result")
 	replace         = flag.Bool("replace", false, "replace source file with instrumentation result")
 	patches         = flag.String("patches", "", "patch file separated by ,")
 	funcExcludeExpr = flag.String("exclude_func_expr", "", "regex pattern of function to exclude from instrumentation")
+	funcIncludeExpr = flag.String("include_func_expr", "", "regex pattern of function to instrument, others are excluded")
+	typeCheck       = flag.Bool("typecheck", false, "load type information of source packages to detect context params")
+	remove          = flag.Bool("remove", false, "remove previously injected code from source files, patches are not needed")
+	showDiff        = flag.Bool("diff", false, "print unified diff of instrumentation result instead of saving it")
+	check           = flag.Bool("check", false, "exit with non-zero code if any file would change, nothing is saved")
+	reportFile      = flag.String("report", "", "json file to write report of instrumented and skipped functions")
+	configFile      = flag.String("config", "", "yaml or json config file of patch sets and rules selecting functions")
+	funcLit         = flag.Bool("func_lit", false, "instrument function literals too, eg: goroutine bodies and closures")
+	typeParams      = flag.Bool("type_params", false, "include type params in names of generic functions, eg: (*Map[K,V]).Get")
+	spanName        = flag.String("span_name", "", "text/template of span names, eg: {{.ImportPath}}.{{.Receiver}}.{{.Func}}")
+	naming          = flag.String("naming", "hash", "naming strategy of injected vars, hash: stable names, time: names differ in every run")
+	verify          = flag.Bool("verify", false, "parse and type check instrumented source, report patch whose code fails to compile")
+	rollback        = flag.Bool("rollback", false, "keep source file uninstrumented if verification fails, implies verify")
+	overlayFile     = flag.String("overlay", "", "json file to write go build -overlay config, instrumented files are stored in output or temp dir")
+	toolexec        = flag.Bool("toolexec", false, "run as go build -toolexec tool, go files are instrumented at build time")
+	ctxAccessors    = ctxAccessorFlag{}
 )
 
+func init() {
+	flag.Var(ctxAccessors, "ctx_accessor",
+		"context accessor of param type, format: type=get[=set], eg: *github.com/gin-gonic/gin.Context=.Request.Context(), repeatable")
+}
+
+// ctxAccessorFlag parse -ctx_accessor=type=get[=set] into accessors of param types
+type ctxAccessorFlag map[string]rewriter.CtxAccessor
+
+func (ctxAccessorFlag) String() string {
+	return ""
+}
+
+func (f ctxAccessorFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid ctx accessor %s, format: type=get[=set]", v)
+	}
+	accessor := rewriter.CtxAccessor{Get: parts[1]}
+	if len(parts) == 3 {
+		accessor.Set = parts[2]
+	}
+	f[parts[0]] = accessor
+	return nil
+}
+
 func usage() {
 	txt := `
-	Usage: tool -source=[source filename] -output=[optional] -replace[optional] -patches=[patch file list]
-	            -exclude_func_expr=[optional]
+	Usage: tool -source=[source file, dir or pattern list] -output=[optional] -replace[optional]
+	            -patches=[patch file list] -exclude_func_expr=[optional] -include_func_expr=[optional]
+	            -typecheck[optional]
+	            -ctx_accessor=[optional, repeatable] -remove[optional] -diff[optional] -check[optional]
+	            -naming=[optional, hash or time] -func_lit[optional] -type_params[optional] -config=[optional]
+	            -report=[optional] -span_name=[optional]
+	            -verify[optional] -rollback[optional]
+	       tool -source=[source list] -patches=[patch file list] -overlay=[overlay json file] -output=[optional]
+	       go build -toolexec='tool -toolexec -patches=[absolute patch file list] [options]' [packages]
 		   must provide source and patches option, if replace is provided, source file content will be overwritten,
-		   otherwise output filename should be provided 
+		   otherwise output filename should be provided, output is a dir when source is a dir or package pattern.
+		   if diff or check is provided, nothing is saved, diff prints unified diff of every changed file,
+		   check exits with non-zero code if any file would change, failed files and setup errors exit with
+		   non-zero code in all modes.
+		   source can be go files, dirs, or dirs ends with /... like ./..., separated by ,
+		   if remove is provided, injected code is removed from source files, and patches is not needed.
+		   patches can also be declared in patch sets of config, rules of config select functions to instrument.
+		   functions with //instrument:include comment are selected regardless of include and exclude patterns,
+		   //instrument:patches=Name1,Name2 comment applies only the named patch functions to function.
+		   span_name is a text/template of span names with fields ImportPath, Package, File, Line, Receiver, Func
+		   and IsPointerRecv, eg: {{.ImportPath}}.{{if .Receiver}}{{.Receiver}}.{{end}}{{.Func}}
+		   report writes a json record of every file and function, including span names, applied patches,
+		   skip reasons and errors.
+		   if verify is provided, instrumented source is parsed and type checked before saving, file fails with
+		   the patch whose injected code does not compile, rollback keeps the file uninstrumented instead.
+		   if toolexec is provided, go files of main module are instrumented into temp dir when they are compiled,
+		   source files are untouched, source, output and replace are not needed.
+		   if overlay is provided, instrumented files are stored in output dir(or a temp dir), and overlay config
+		   mapping source files to them is written for go build -overlay, source files are untouched.
 	`
 	fmt.Fprintf(os.Stderr, "%s\n\n", txt)
 }
 
+type summary struct {
+	total, rewritten, unchanged, failed int
+}
+
 func main() {
 	flag.Usage = usage
 	flag.Parse()
-	if *source == "" || *patches == "" || (*output == "" && !*replace) {
+	dryRun := *showDiff || *check
+	if *toolexec {
+		if *patches == "" && *configFile == "" {
+			flag.Usage()
+			flag.PrintDefaults()
+			os.Exit(2)
+		}
+	} else if *source == "" || (*patches == "" && *configFile == "" && !*remove) ||
+		(*output == "" && !*replace && !dryRun && *overlayFile == "") ||
+		(*overlayFile != "" && (*replace || *remove || dryRun)) {
 		flag.Usage()
 		flag.PrintDefaults()
-		return
+		os.Exit(2)
 	}
-	if *funcExcludeExpr != "" {
-		filter.FuncNameExcludeExpr = regexp.MustCompile(*funcExcludeExpr)
+	opts := instrument.Options{PatchFiles: splitList(*patches), FuncLit: *funcLit, TypeParams: *typeParams,
+		SpanNameTemplate: *spanName, CtxAccessors: ctxAccessors, Verify: *verify || *rollback, Rollback: *rollback}
+	var err error
+	if opts.ExcludeFuncExpr, err = compileFuncExpr(*funcExcludeExpr); err != nil {
+		exitf("invalid exclude_func_expr, err: %+v", err)
 	}
-	// parse source file
-	sourceMeta, err := parser.ParseFile(*source)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "parse source %s failed, err: %+v\n", *source, err)
-		return
-	}
-	// parse patches
-	patchFiles := strings.Split(*patches, ",")
-	patchMetas := make([]parser.FileMeta, 0, len(patchFiles))
-	for _, f := range patchFiles {
-		meta, err := parser.ParseFile(f)
+	if opts.IncludeFuncExpr, err = compileFuncExpr(*funcIncludeExpr); err != nil {
+		exitf("invalid include_func_expr, err: %+v", err)
+	}
+	switch *naming {
+	case "hash":
+		opts.Naming = rewriter.NamingHash
+	case "time":
+		opts.Naming = rewriter.NamingTime
+	default:
+		exitf("unknown naming strategy %s, hash or time expected", *naming)
+	}
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "parse patch %s, failed, err: %+v\n", f, err)
-			continue
+			exitf("load config failed, err: %+v", err)
 		}
-		patchMetas = append(patchMetas, meta)
-	}
-	defer func() {
-		if e := recover(); e != nil {
-			buf := [1024]byte{}
-			sbuf := buf[:runtime.Stack(buf[:], false)]
-			fmt.Fprintf(os.Stderr, "auto instrumentation exec failed, file: %s, err: %+v, stack: %s\n",
-				*source, e, string(sbuf))
+		opts.Config = cfg
+	}
+	if *toolexec {
+		opts.TypeCheck = *typeCheck
+		os.Exit(runToolexec(opts, os.Args[1:len(os.Args)-flag.NArg()], flag.Args()))
+	}
+	opts.TypeCheck, opts.Remove, opts.DryRun = *typeCheck, *remove, dryRun
+	if !*replace {
+		opts.Output = *output
+	}
+	if *overlayFile != "" && opts.Output == "" {
+		dir, err := os.MkdirTemp("", "instrument-overlay-")
+		if err != nil {
+			exitf("create overlay dir failed, err: %+v", err)
 		}
-	}()
-	if err = rewriter.RewriteSourceFile(&sourceMeta, patchMetas); err != nil {
-		fmt.Fprintf(os.Stderr, "rewrite source %s failed, err: %+v\n", *source, err)
-		return
+		opts.Output = dir
 	}
-	if *replace {
-		*output = *source
+	instrumenter, err := instrument.NewInstrumenter(opts)
+	if err != nil {
+		exitf("prepare patches failed, err: %+v", err)
+	}
+	if patchSet := instrumenter.PatchSet(); patchSet != nil {
+		for _, invalid := range patchSet.Invalid {
+			fmt.Fprintf(os.Stderr, "patch %s is ignored, err: %+v\n", invalid.FileName, invalid.Err)
+		}
 	}
-	if err = saveInstrmentation(sourceMeta, *output); err != nil {
-		fmt.Fprintf(os.Stderr, "save instrumentation failed, err: %+v\n", err)
-		return
+	sourcePatterns := strings.Split(*source, ",")
+	var result instrument.Result
+	if len(sourcePatterns) == 1 && isRegularFile(sourcePatterns[0]) && *overlayFile == "" {
+		fileResult, _ := instrumenter.InstrumentFile(sourcePatterns[0])
+		result.Files = append(result.Files, fileResult)
+	} else if result, err = instrumenter.InstrumentPackages(sourcePatterns...); err != nil {
+		exitf("expand source %s failed, err: %+v", *source, err)
+	}
+	if len(result.Files) == 0 {
+		exitf("no source file matched %s", *source)
+	}
+	var sum summary
+	for _, f := range result.Files {
+		sum.total++
+		for _, warning := range f.Warnings {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		switch {
+		case f.Err != nil:
+			sum.failed++
+			fmt.Fprintf(os.Stderr, "instrument source %s failed, err: %+v\n", f.Filename, f.Err)
+		case f.Changed:
+			sum.rewritten++
+			if *showDiff {
+				os.Stdout.Write(diff.Unified(f.Filename, f.Filename, f.Original, f.Content))
+			}
+		default:
+			sum.unchanged++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "instrumentation finished, files: %d, rewritten: %d, unchanged: %d, failed: %d\n",
+		sum.total, sum.rewritten, sum.unchanged, sum.failed)
+	if *reportFile != "" {
+		if err := instrument.NewReport(instrumenter.PatchSet(), result).WriteFile(*reportFile); err != nil {
+			fmt.Fprintf(os.Stderr, "write report failed, err: %+v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *overlayFile != "" {
+		overlay, err := instrument.NewOverlay(result)
+		if err == nil {
+			err = overlay.WriteFile(*overlayFile)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "write overlay failed, err: %+v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "overlay written to %s, build with: go build -overlay=%s\n", *overlayFile, *overlayFile)
+	}
+	// failed files are not saved in any mode, scripts and CI checks should notice partial failure
+	if sum.failed > 0 || (*check && sum.rewritten > 0) {
+		os.Exit(1)
 	}
 }
 
-func saveInstrmentation(meta parser.FileMeta, filename string) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("open file %s failed: %w", filename, err)
+// exitf print error and exit with non-zero code, so scripts and CI checks notice broken setup,
+// report with the error is written if report is provided
+func exitf(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	fmt.Fprintln(os.Stderr, err)
+	if *reportFile != "" {
+		if reportErr := instrument.NewErrorReport(err).WriteFile(*reportFile); reportErr != nil {
+			fmt.Fprintf(os.Stderr, "write report failed, err: %+v\n", reportErr)
+		}
 	}
-	defer f.Close()
-	if n, err := f.Write(meta.Content); err != nil || n != len(meta.Content) {
-		return fmt.Errorf("write file %s failed: write size %d, expected size: %d, err: %w",
-			filename, n, len(meta.Content), err)
+	os.Exit(1)
+}
+
+// compileFuncExpr compile regex pattern of function names, nil is returned if pattern is empty
+func compileFuncExpr(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
 	}
-	return nil
+	return regexp.Compile(pattern)
+}
+
+// splitList split comma separated list, empty elements are ignored
+func splitList(list string) []string {
+	var elems []string
+	for _, elem := range strings.Split(list, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
+func isRegularFile(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Mode().IsRegular()
 }
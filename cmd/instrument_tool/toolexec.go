@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jattle/go-instrumentation/instrument"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+// toolexec mode, tool is invoked by `go build -toolexec='instrument_tool -toolexec -patches=...'` as
+//
+//	instrument_tool [flags] /path/to/tool [tool args]
+//
+// go files passed to compile are instrumented into a temp dir, and the modified file list is forwarded to compile,
+// packages imported by injected code are added into importcfg of compile and link, other tools are executed as is.
+// standard library, packages of module cache and vendor dirs are never instrumented.
+
+// sanitizer flags of compile and link, packages added into importcfg should be built with the same flags
+var sanitizerFlags = []string{"-race", "-msan", "-asan"}
+
+// runToolexec run tool of toolexec invocation, exit code of tool is returned
+func runToolexec(opts instrument.Options, toolexecArgs, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "toolexec: tool not provided\n")
+		return 2
+	}
+	tool, toolArgs := args[0], args[1:]
+	if len(toolArgs) > 0 && strings.HasPrefix(toolArgs[0], "-V") {
+		// tool id query, instrumentation is part of tool id, so cached results of build without
+		// instrumentation or with other patches are not reused
+		if err := printToolID(tool, toolArgs, opts, toolexecArgs); err != nil {
+			fmt.Fprintf(os.Stderr, "toolexec: %+v\n", err)
+			return 1
+		}
+		return 0
+	}
+	var tmpDir string
+	var err error
+	switch toolName(tool) {
+	case "compile":
+		toolArgs, tmpDir, err = instrumentCompile(opts, toolArgs)
+	case "link":
+		toolArgs, tmpDir, err = extendLinkImportcfg(opts, toolArgs)
+	}
+	if tmpDir != "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "toolexec: %s failed, err: %+v\n", toolName(tool), err)
+		return 1
+	}
+	return runTool(tool, toolArgs)
+}
+
+func toolName(tool string) string {
+	return strings.TrimSuffix(filepath.Base(tool), ".exe")
+}
+
+func runTool(tool string, args []string) int {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "toolexec: run %s failed, err: %+v\n", tool, err)
+		return 1
+	}
+	return 0
+}
+
+// printToolID print version of tool with id of instrumentation, go uses the whole line as tool id for release
+// versions, and content id of the last buildID field for devel versions, so id of instrumentation is appended to it
+func printToolID(tool string, args []string, opts instrument.Options, toolexecArgs []string) error {
+	out, err := exec.Command(tool, args...).Output()
+	if err != nil {
+		return fmt.Errorf("get version of %s failed: %w", tool, err)
+	}
+	id, err := instrumentationID(opts, toolexecArgs)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return fmt.Errorf("unexpected version of %s: %s", tool, out)
+	}
+	if len(fields) >= 3 && strings.Contains(fields[2], "devel") {
+		fields[len(fields)-1] += "-instrument" + id
+	} else {
+		fields = append(fields, "instrument="+id)
+	}
+	fmt.Println(strings.Join(fields, " "))
+	return nil
+}
+
+// instrumentationID hash of toolexec flags and contents of patch and config files
+func instrumentationID(opts instrument.Options, toolexecArgs []string) (string, error) {
+	h := sha256.New()
+	for _, arg := range toolexecArgs {
+		fmt.Fprintf(h, "%s\x00", arg)
+	}
+	files := append([]string{}, opts.PatchFiles...)
+	if opts.Config != nil {
+		files = append(files, opts.Config.PatchFiles()...)
+	}
+	if *configFile != "" {
+		files = append(files, *configFile)
+	}
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("read %s failed: %w", f, err)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", f, len(content))
+		h.Write(content)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// instrumentCompile instrument go files of compile args into temp dir, and replace them in args
+func instrumentCompile(opts instrument.Options, args []string) (newArgs []string, tmpDir string, err error) {
+	if args, err = expandResponseFiles(args); err != nil {
+		return nil, "", err
+	}
+	if hasFlag(args, "-std") {
+		return args, "", nil
+	}
+	env, err := goEnv("GOROOT", "GOMODCACHE")
+	if err != nil {
+		return nil, "", err
+	}
+	var files []int
+	for i, arg := range args {
+		if !strings.HasSuffix(arg, ".go") || strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if inDir(arg, env["GOROOT"]) || inDir(arg, env["GOMODCACHE"]) || inVendor(arg) {
+			// dependencies are not instrumented
+			return args, "", nil
+		}
+		// files generated by cgo are kept as is
+		if base := filepath.Base(arg); !strings.HasPrefix(base, "_cgo_") && !strings.HasSuffix(base, ".cgo1.go") {
+			files = append(files, i)
+		}
+	}
+	if len(files) == 0 {
+		return args, "", nil
+	}
+	opts.DryRun, opts.Output = true, ""
+	instrumenter, err := instrument.NewInstrumenter(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if tmpDir, err = os.MkdirTemp("", "instrument-compile-"); err != nil {
+		return nil, "", err
+	}
+	imports := make(map[string]struct{})
+	newArgs = append([]string{}, args...)
+	for _, i := range files {
+		// line directives of instrumented file refer to source file by absolute path, since it is compiled in temp dir
+		filename, err := filepath.Abs(args[i])
+		if err != nil {
+			return nil, tmpDir, err
+		}
+		result, err := instrumenter.InstrumentFile(filename)
+		if err != nil {
+			return nil, tmpDir, err
+		}
+		if !result.Changed {
+			continue
+		}
+		meta, err := parser.ParseContent(result.Filename, result.Content)
+		if err != nil {
+			return nil, tmpDir, err
+		}
+		for _, spec := range meta.ASTFile.Imports {
+			if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports[importPath] = struct{}{}
+			}
+		}
+		// files of one package are in the same dir, except files generated by cgo
+		output := filepath.Join(tmpDir, fmt.Sprintf("%d_%s", i, filepath.Base(args[i])))
+		if err = os.WriteFile(output, result.Content, 0644); err != nil {
+			return nil, tmpDir, err
+		}
+		newArgs[i] = output
+	}
+	if err = extendImportcfg(newArgs, tmpDir, imports, false); err != nil {
+		return nil, tmpDir, err
+	}
+	return newArgs, tmpDir, nil
+}
+
+// extendLinkImportcfg add packages imported by patches and their dependencies into importcfg of link
+func extendLinkImportcfg(opts instrument.Options, args []string) (newArgs []string, tmpDir string, err error) {
+	if args, err = expandResponseFiles(args); err != nil {
+		return nil, "", err
+	}
+	opts.DryRun, opts.Output = true, ""
+	instrumenter, err := instrument.NewInstrumenter(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	imports := map[string]struct{}{"context": {}, "runtime/debug": {}}
+	for _, patch := range instrumenter.PatchSet().Patches {
+		for _, spec := range patch.ASTFile.Imports {
+			if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports[importPath] = struct{}{}
+			}
+		}
+	}
+	if tmpDir, err = os.MkdirTemp("", "instrument-link-"); err != nil {
+		return nil, "", err
+	}
+	if err = extendImportcfg(args, tmpDir, imports, true); err != nil {
+		return nil, tmpDir, err
+	}
+	return args, tmpDir, nil
+}
+
+// extendImportcfg add packagefile of imports missing in importcfg of args, export data is built by go list,
+// a new importcfg is written into tmpDir and replaces the original one in args.
+func extendImportcfg(args []string, tmpDir string, imports map[string]struct{}, deps bool) error {
+	index := -1
+	for i, arg := range args {
+		if arg == "-importcfg" && i+1 < len(args) {
+			index = i + 1
+		}
+	}
+	if index < 0 || len(imports) == 0 {
+		return nil
+	}
+	content, err := os.ReadFile(args[index])
+	if err != nil {
+		return fmt.Errorf("read importcfg failed: %w", err)
+	}
+	known := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		verb, rest, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if verb == "packagefile" || verb == "importmap" {
+			importPath, _, _ := strings.Cut(rest, "=")
+			known[importPath] = struct{}{}
+		}
+	}
+	var missing []string
+	for importPath := range imports {
+		if _, ok := known[importPath]; !ok && importPath != "unsafe" && importPath != "C" {
+			missing = append(missing, importPath)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	listArgs := []string{"list", "-export", "-f", "{{if .Export}}{{.ImportPath}}={{.Export}}{{end}}"}
+	if deps {
+		listArgs = append(listArgs, "-deps")
+	}
+	for _, flag := range sanitizerFlags {
+		if hasFlag(args, flag) {
+			listArgs = append(listArgs, flag)
+		}
+	}
+	out, err := exec.Command("go", append(listArgs, missing...)...).Output()
+	if err != nil {
+		return fmt.Errorf("go list export data of %s failed: %w", strings.Join(missing, ","), err)
+	}
+	buf := bytes.NewBuffer(append(bytes.TrimRight(content, "\n"), '\n'))
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		importPath, _, ok := strings.Cut(line, "=")
+		if _, exists := known[importPath]; ok && !exists {
+			fmt.Fprintf(buf, "packagefile %s\n", line)
+		}
+	}
+	importcfg := filepath.Join(tmpDir, "importcfg")
+	if err = os.WriteFile(importcfg, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	args[index] = importcfg
+	return nil
+}
+
+// expandResponseFiles expand @file args written by go command when command line is too long,
+// every line of response file is an arg with \ and newline escaped.
+func expandResponseFiles(args []string) ([]string, error) {
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		content, err := os.ReadFile(arg[1:])
+		if err != nil {
+			return nil, fmt.Errorf("read response file %s failed: %w", arg[1:], err)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			expanded = append(expanded, decodeResponseArg(line))
+		}
+	}
+	return expanded, nil
+}
+
+func decodeResponseArg(arg string) string {
+	var b strings.Builder
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '\\' && i+1 < len(arg) {
+			i++
+			if arg[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(arg[i])
+	}
+	return b.String()
+}
+
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag || arg == flag+"=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// goEnv values of go env vars
+func goEnv(names ...string) (map[string]string, error) {
+	out, err := exec.Command("go", append([]string{"env"}, names...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go env failed: %w", err)
+	}
+	values := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	env := make(map[string]string, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			env[name] = values[i]
+		}
+	}
+	return env, nil
+}
+
+// inDir whether file is in dir or its sub dirs
+func inDir(file, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// inVendor whether file is in vendor dir, eg: dependencies built with -mod=vendor
+func inVendor(file string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(filepath.Dir(file)), "/") {
+		if elem == "vendor" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument"
+	"gotest.tools/assert"
+)
+
+const testPatchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName)
+}
+`
+
+func TestInstrumentCompile(t *testing.T) {
+	dir := t.TempDir()
+	patch := filepath.Join(dir, "patch.go")
+	assert.NilError(t, os.WriteFile(patch, []byte(testPatchContent), 0644))
+	const content = "package a\n\nfunc A() {}\n"
+	for _, file := range []string{"a/a.go", "vendor/example.com/b/b.go"} {
+		filename := filepath.Join(dir, file)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		assert.NilError(t, os.WriteFile(filename, []byte(content), 0644))
+	}
+	env, err := goEnv("GOROOT")
+	assert.NilError(t, err)
+	tests := []struct {
+		file         string
+		instrumented bool
+	}{
+		{file: filepath.Join(dir, "a/a.go"), instrumented: true},
+		// dependencies are compiled as is
+		{file: filepath.Join(dir, "vendor/example.com/b/b.go")},
+		{file: filepath.Join(env["GOROOT"], "src/fmt/print.go")},
+	}
+	opts := instrument.Options{PatchFiles: []string{patch}}
+	for _, tt := range tests {
+		args := []string{"-o", filepath.Join(dir, "_pkg_.a"), "-p", "example.com/a", "-complete", tt.file}
+		newArgs, tmpDir, err := instrumentCompile(opts, args)
+		assert.NilError(t, err, tt.file)
+		if tmpDir != "" {
+			defer os.RemoveAll(tmpDir)
+		}
+		if !tt.instrumented {
+			assert.DeepEqual(t, newArgs, args)
+			assert.Equal(t, tmpDir, "")
+			continue
+		}
+		assert.DeepEqual(t, newArgs[:len(args)-1], args[:len(args)-1])
+		assert.Assert(t, inDir(newArgs[len(args)-1], tmpDir), newArgs[len(args)-1])
+		instrumented, err := os.ReadFile(newArgs[len(args)-1])
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(string(instrumented), "//instrument:begin Entry"))
+	}
+}
@@ -0,0 +1,46 @@
+package demo
+
+import (
+	"context"
+	"testing"
+)
+
+func plainArgs(ctx context.Context, id int, name string, tags []string) int {
+	return id + len(name) + len(tags)
+}
+
+// eagerArgs calls patch with args boxed before the call, like code injected by InstrumentTraceArgs
+func eagerArgs(ctx context.Context, id int, name string, tags []string) int {
+	InstrumentTraceArgs("eagerArgs", true, ctx, ctx, id, name, tags)
+	return id + len(name) + len(tags)
+}
+
+// lazyArgs calls patch with args boxed by closure, like code injected by InstrumentTraceLazyArgs
+func lazyArgs(ctx context.Context, id int, name string, tags []string) int {
+	InstrumentTraceLazyArgs("lazyArgs", true, ctx, func() []interface{} {
+		return []interface{}{ctx, id, name, tags}
+	})
+	return id + len(name) + len(tags)
+}
+
+// BenchmarkArgs overhead of patches with args boxed eagerly and lazily, args are not logged since go trace is
+// not enabled
+func BenchmarkArgs(b *testing.B) {
+	ctx, tags := context.Background(), []string{"a", "b"}
+	benchmarks := []struct {
+		name string
+		fn   func(context.Context, int, string, []string) int
+	}{
+		{name: "plain", fn: plainArgs},
+		{name: "eager", fn: eagerArgs},
+		{name: "lazy", fn: lazyArgs},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.fn(ctx, i, "name", tags)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package demo
+
+import (
+	gonativectx "context"
+	"runtime/trace"
+)
+
+// InstrumentArgsLog instrumentation function example logging args as key/value pairs using go trace,
+// names and types of args are read from static descriptor of source function without reflection
+// usage: go-instrument-tool -source=./... -replace -patches=xxx/demo/instrument_args_log.go
+func InstrumentArgsLog(spanName string, _ bool, ctx gonativectx.Context, fn *struct {
+	Func       string
+	File       string
+	Line       int
+	ParamNames []string
+	ParamTypes []string
+}, args func() []interface{}) {
+	if trace.IsEnabled() {
+		values := args()
+		for i, name := range fn.ParamNames {
+			trace.Logf(ctx, spanName, "%s:%d %s %s=%v", fn.File, fn.Line, fn.ParamTypes[i], name, values[i])
+		}
+	}
+}
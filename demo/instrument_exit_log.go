@@ -0,0 +1,17 @@
+package demo
+
+import (
+	gonativectx "context"
+	"encoding/json"
+	"runtime/trace"
+)
+
+// InstrumentExitLog exit instrumentation function example, log results and error of function using go trace
+// usage: go-instrument-tool -source=./... -replace -patches=xxx/demo/instrument_go_trace.go,xxx/demo/instrument_exit_log.go
+func InstrumentExitLog(spanName string, ctx gonativectx.Context, err error, results ...interface{}) {
+	logbin, _ := json.Marshal(results)
+	trace.Logf(ctx, spanName, "function results: %s", string(logbin))
+	if err != nil {
+		trace.Logf(ctx, spanName, "function error: %v", err)
+	}
+}
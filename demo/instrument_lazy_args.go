@@ -0,0 +1,24 @@
+package demo
+
+import (
+	gonativectx "context"
+	"fmt"
+	"runtime/trace"
+)
+
+// InstrumentTraceArgs instrumentation function example logging args only when go trace is enabled,
+// args are boxed on every call even if they are not logged
+func InstrumentTraceArgs(spanName string, _ bool, ctx gonativectx.Context, args ...interface{}) {
+	if trace.IsEnabled() {
+		trace.Log(ctx, spanName, fmt.Sprint(args...))
+	}
+}
+
+// InstrumentTraceLazyArgs same as InstrumentTraceArgs, but args are declared in lazy form,
+// so they are boxed only when go trace is enabled
+// usage: go-instrument-tool -source=./... -replace -patches=xxx/demo/instrument_lazy_args.go
+func InstrumentTraceLazyArgs(spanName string, _ bool, ctx gonativectx.Context, args func() []interface{}) {
+	if trace.IsEnabled() {
+		trace.Log(ctx, spanName, fmt.Sprint(args()...))
+	}
+}
@@ -0,0 +1,13 @@
+package demo
+
+import (
+	gonativectx "context"
+	"runtime/trace"
+)
+
+// InstrumentPanicLog panic instrumentation function example, log recovered value and stack using go trace,
+// panic is re-raised after logging
+// usage: go-instrument-tool -source=./... -replace -patches=xxx/demo/instrument_go_trace.go,xxx/demo/instrument_panic_log.go
+func InstrumentPanicLog(spanName string, ctx gonativectx.Context, recovered interface{}, stack []byte) {
+	trace.Logf(ctx, spanName, "function panic: %v, stack: %s", recovered, string(stack))
+}
@@ -0,0 +1,342 @@
+// Package config load instrumentation rules from yaml or json file, rules select source functions to instrument
+// and patch sets applied to them.
+//
+// example:
+//
+//	patch_sets:
+//	  trace: [patches/trace.go]
+//	  log: [patches/exit_log.go, patches/panic_log.go]
+//	rules:
+//	  - name: handlers
+//	    include:
+//	      - packages: [github.com/a/b/handler/...]
+//	        visibility: exported
+//	    exclude:
+//	      - files: ["*_gen.go"]
+//	      - funcs: ["^Must"]
+//	    patch_sets: [trace, log]
+//	  - name: others
+//	    include:
+//	      - receivers: ["*Server"]
+//	    patch_sets: [log]
+//
+// rules are matched in order, the first rule matching a function decides patch sets applied to it, functions
+// matched by no rule are not instrumented. if no rule is declared, all functions are instrumented by all patches.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// VisibilityExported exported functions, whose names start with upper case letter
+	VisibilityExported = "exported"
+	// VisibilityUnexported unexported functions
+	VisibilityUnexported = "unexported"
+)
+
+// Config instrumentation rules
+type Config struct {
+	// PatchSets named lists of patch files, relative paths are relative to dir of config file
+	PatchSets map[string][]string `json:"patch_sets" yaml:"patch_sets"`
+	// Rules select functions and patch sets applied to them
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule select functions matched by any selector of Include but not matched by any selector of Exclude
+type Rule struct {
+	Name string `json:"name" yaml:"name"`
+	// Include functions matched are selected, all functions are matched if empty
+	Include []Selector `json:"include" yaml:"include"`
+	// Exclude functions matched are not selected
+	Exclude []Selector `json:"exclude" yaml:"exclude"`
+	// PatchSets names of patch sets applied to selected functions, all patch sets are applied if empty
+	PatchSets []string `json:"patch_sets" yaml:"patch_sets"`
+}
+
+// Selector match function if all non-empty fields match, and a list field matches if any of its elements matches
+type Selector struct {
+	// Packages import paths of packages, path ends with /... matches all sub packages, ... matches all packages
+	Packages []string `json:"packages" yaml:"packages"`
+	// Files glob patterns of file, pattern without / matches base name of file, otherwise matches the end of
+	// file path, eg: *_gen.go, handler/*.go
+	Files []string `json:"files" yaml:"files"`
+	// Receivers receiver type names of methods, eg: *Server, Server, empty name matches functions without receiver
+	Receivers []string `json:"receivers" yaml:"receivers"`
+	// Funcs regex patterns of function names
+	Funcs []string `json:"funcs" yaml:"funcs"`
+	// Visibility exported or unexported
+	Visibility string `json:"visibility" yaml:"visibility"`
+
+	funcExprs []*regexp.Regexp
+}
+
+// FuncInfo function to match
+type FuncInfo struct {
+	// PkgPath import path of package, selectors of packages other than ... do not match it if empty
+	PkgPath string
+	// File path of source file
+	File string
+	// Receiver receiver type name without type params, eg: *Server, empty for functions without receiver
+	Receiver string
+	// Name function name
+	Name string
+}
+
+// Load config from yaml or json file, format is decided by file extension, yaml is used except .json,
+// relative paths of patch files are resolved to dir of config file.
+func Load(filename string) (*Config, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s failed: %w", filename, err)
+	}
+	cfg, err := Parse(content, strings.EqualFold(filepath.Ext(filename), ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s failed: %w", filename, err)
+	}
+	dir := filepath.Dir(filename)
+	for name, files := range cfg.PatchSets {
+		for i, file := range files {
+			if !filepath.IsAbs(file) {
+				files[i] = filepath.Join(dir, file)
+			}
+		}
+		cfg.PatchSets[name] = files
+	}
+	return cfg, nil
+}
+
+// Parse config content in yaml or json, unknown fields are not allowed
+func Parse(content []byte, isJSON bool) (*Config, error) {
+	cfg := &Config{}
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		// empty content is valid config
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate validate config and compile patterns, config created by code must be validated before matching
+func (c *Config) Validate() error {
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		for _, name := range rule.PatchSets {
+			if _, ok := c.PatchSets[name]; !ok {
+				return fmt.Errorf("rule %d(%s): patch set %s not declared", i, rule.Name, name)
+			}
+		}
+		for _, selectors := range [][]Selector{rule.Include, rule.Exclude} {
+			for j := range selectors {
+				if err := selectors[j].init(); err != nil {
+					return fmt.Errorf("rule %d(%s): %w", i, rule.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PatchFiles patch files of all patch sets, deduplicated and sorted by patch set names
+func (c *Config) PatchFiles() []string {
+	names := make([]string, 0, len(c.PatchSets))
+	for name := range c.PatchSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return c.patchFilesOf(names)
+}
+
+// Match get patch files applied to function, ok is false if function is not selected by any rule,
+// files is nil if all patches should be applied.
+func (c *Config) Match(fn FuncInfo) (files []string, ok bool) {
+	if len(c.Rules) == 0 {
+		return nil, true
+	}
+	for _, rule := range c.Rules {
+		if len(rule.Include) > 0 && !matchAny(rule.Include, fn) {
+			continue
+		}
+		if matchAny(rule.Exclude, fn) {
+			continue
+		}
+		if len(rule.PatchSets) == 0 {
+			return nil, true
+		}
+		return c.patchFilesOf(rule.PatchSets), true
+	}
+	return nil, false
+}
+
+// MatchPackages whether functions are matched by import paths of packages, PkgPath of FuncInfo should be resolved
+// to match them
+func (c *Config) MatchPackages() bool {
+	for _, rule := range c.Rules {
+		for _, selectors := range [][]Selector{rule.Include, rule.Exclude} {
+			for _, s := range selectors {
+				if len(s.Packages) > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(selectors []Selector, fn FuncInfo) bool {
+	for i := range selectors {
+		if selectors[i].Match(fn) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) patchFilesOf(names []string) []string {
+	files := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		for _, file := range c.PatchSets[name] {
+			if _, ok := seen[file]; !ok {
+				seen[file] = struct{}{}
+				files = append(files, file)
+			}
+		}
+	}
+	return files
+}
+
+func (s *Selector) init() error {
+	switch s.Visibility {
+	case "", VisibilityExported, VisibilityUnexported:
+	default:
+		return fmt.Errorf("invalid visibility %s, %s or %s expected", s.Visibility, VisibilityExported,
+			VisibilityUnexported)
+	}
+	for _, pattern := range s.Files {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %s: %w", pattern, err)
+		}
+	}
+	s.funcExprs = s.funcExprs[:0]
+	for _, pattern := range s.Funcs {
+		expr, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid func pattern %s: %w", pattern, err)
+		}
+		s.funcExprs = append(s.funcExprs, expr)
+	}
+	return nil
+}
+
+// Match whether function is matched by selector
+func (s *Selector) Match(fn FuncInfo) bool {
+	return s.matchPackage(fn.PkgPath) && s.matchFile(fn.File) && s.matchReceiver(fn.Receiver) &&
+		s.matchFunc(fn.Name) && s.matchVisibility(fn.Name)
+}
+
+func (s *Selector) matchPackage(pkgPath string) bool {
+	if len(s.Packages) == 0 {
+		return true
+	}
+	for _, pattern := range s.Packages {
+		switch {
+		case pattern == "...":
+			return true
+		case pkgPath == "":
+			// unresolved package is not matched, instead of being included or excluded by any package
+			continue
+		case strings.HasSuffix(pattern, "/..."):
+			prefix := strings.TrimSuffix(pattern, "/...")
+			if pkgPath == prefix || strings.HasPrefix(pkgPath, prefix+"/") {
+				return true
+			}
+		case pattern == pkgPath:
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) matchFile(file string) bool {
+	if len(s.Files) == 0 {
+		return true
+	}
+	file = filepath.ToSlash(filepath.Clean(file))
+	for _, pattern := range s.Files {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(file)); ok {
+				return true
+			}
+			continue
+		}
+		// match the end of file path by the same number of elements
+		elems := strings.Split(file, "/")
+		if n := strings.Count(pattern, "/") + 1; n <= len(elems) {
+			if ok, _ := path.Match(pattern, strings.Join(elems[len(elems)-n:], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Selector) matchReceiver(receiver string) bool {
+	if len(s.Receivers) == 0 {
+		return true
+	}
+	for _, r := range s.Receivers {
+		if r == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) matchFunc(name string) bool {
+	if len(s.Funcs) == 0 {
+		return true
+	}
+	// patterns not compiled by Validate match nothing, instead of all functions
+	for _, expr := range s.funcExprs {
+		if expr.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) matchVisibility(name string) bool {
+	switch s.Visibility {
+	case VisibilityExported:
+		return token.IsExported(name)
+	case VisibilityUnexported:
+		return !token.IsExported(name)
+	}
+	return true
+}
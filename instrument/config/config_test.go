@@ -0,0 +1,148 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+const testConfig = `
+patch_sets:
+  trace: [trace.go]
+  log: [exit_log.go, /abs/panic_log.go]
+rules:
+  - name: handlers
+    include:
+      - packages: [github.com/a/b/handler/...]
+        visibility: exported
+    exclude:
+      - files: ["*_gen.go", "legacy/*.go"]
+      - funcs: ["^Must"]
+    patch_sets: [trace, log]
+  - name: servers
+    include:
+      - receivers: ["*Server"]
+    patch_sets: [log]
+  - name: all
+    include:
+      - packages: [github.com/a/b/internal]
+`
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "instrument.yaml")
+	assert.NilError(t, os.WriteFile(filename, []byte(testConfig), 0o644))
+	cfg, err := Load(filename)
+	assert.NilError(t, err)
+	trace, exitLog := filepath.Join(dir, "trace.go"), filepath.Join(dir, "exit_log.go")
+	assert.DeepEqual(t, cfg.PatchFiles(), []string{exitLog, "/abs/panic_log.go", trace})
+	cases := []struct {
+		fn    FuncInfo
+		files []string
+		ok    bool
+	}{
+		{
+			fn:    FuncInfo{PkgPath: "github.com/a/b/handler/user", File: "handler/user/get.go", Name: "Get"},
+			files: []string{trace, exitLog, "/abs/panic_log.go"},
+			ok:    true,
+		},
+		// unexported
+		{fn: FuncInfo{PkgPath: "github.com/a/b/handler", File: "handler/get.go", Name: "get"}},
+		// excluded by file glob of base name and path
+		{fn: FuncInfo{PkgPath: "github.com/a/b/handler", File: "handler/api_gen.go", Name: "Get"}},
+		{fn: FuncInfo{PkgPath: "github.com/a/b/handler/legacy", File: "handler/legacy/get.go", Name: "Get"}},
+		// excluded by func name, but matched by receiver rule
+		{
+			fn:    FuncInfo{PkgPath: "github.com/a/b/handler", File: "handler/s.go", Receiver: "*Server", Name: "MustRun"},
+			files: []string{exitLog, "/abs/panic_log.go"},
+			ok:    true,
+		},
+		// matched by rule without patch sets
+		{fn: FuncInfo{PkgPath: "github.com/a/b/internal", File: "internal/a.go", Name: "a"}, ok: true},
+		// matched by no rule
+		{fn: FuncInfo{PkgPath: "github.com/a/b/internal/x", File: "internal/x/a.go", Name: "a"}},
+		{fn: FuncInfo{PkgPath: "github.com/a/b/handlerx", File: "handlerx/a.go", Name: "A"}},
+	}
+	for _, c := range cases {
+		files, ok := cfg.Match(c.fn)
+		assert.Equal(t, ok, c.ok, "%+v", c.fn)
+		assert.DeepEqual(t, files, c.files)
+	}
+}
+
+func TestMatchUnresolvedPackage(t *testing.T) {
+	cfg, err := Parse([]byte(`
+patch_sets:
+  trace: [trace.go]
+  log: [log.go]
+rules:
+  - include: [{packages: [github.com/a/b/handler/...]}]
+    patch_sets: [trace]
+  - include: [{packages: ["..."]}]
+    exclude: [{packages: [github.com/a/b/gen]}]
+    patch_sets: [log]
+`), false)
+	assert.NilError(t, err)
+	assert.Assert(t, cfg.MatchPackages())
+	cases := []struct {
+		fn    FuncInfo
+		files []string
+		ok    bool
+	}{
+		{fn: FuncInfo{PkgPath: "github.com/a/b/handler", Name: "A"}, files: []string{"trace.go"}, ok: true},
+		{fn: FuncInfo{PkgPath: "github.com/a/b/gen", Name: "A"}},
+		// unresolved package is neither included nor excluded by packages other than ...
+		{fn: FuncInfo{Name: "A"}, files: []string{"log.go"}, ok: true},
+	}
+	for _, c := range cases {
+		files, ok := cfg.Match(c.fn)
+		assert.Equal(t, ok, c.ok, "%+v", c.fn)
+		assert.DeepEqual(t, files, c.files)
+	}
+	cfg, err = Parse([]byte(`rules: [{include: [{funcs: ["^A"]}]}]`), false)
+	assert.NilError(t, err)
+	assert.Assert(t, !cfg.MatchPackages())
+}
+
+func TestMatchNotValidated(t *testing.T) {
+	cfg := &Config{Rules: []Rule{{Include: []Selector{{Funcs: []string{"^Get"}}}}}}
+	_, ok := cfg.Match(FuncInfo{Name: "Get"})
+	assert.Assert(t, !ok)
+	assert.NilError(t, cfg.Validate())
+	_, ok = cfg.Match(FuncInfo{Name: "Get"})
+	assert.Assert(t, ok)
+	_, ok = cfg.Match(FuncInfo{Name: "Set"})
+	assert.Assert(t, !ok)
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`{"rules": [{"include": [{"funcs": ["^Get"], "visibility": "exported"}]}]}`), true)
+	assert.NilError(t, err)
+	_, ok := cfg.Match(FuncInfo{Name: "GetUser"})
+	assert.Assert(t, ok)
+	_, ok = cfg.Match(FuncInfo{Name: "SetUser"})
+	assert.Assert(t, !ok)
+	// empty config selects all functions
+	cfg, err = Parse(nil, false)
+	assert.NilError(t, err)
+	_, ok = cfg.Match(FuncInfo{Name: "a"})
+	assert.Assert(t, ok)
+
+	invalids := []struct {
+		content string
+		isJSON  bool
+		err     string
+	}{
+		{content: `rules: [{patch_sets: [x]}]`, err: "rule 0(): patch set x not declared"},
+		{content: `rules: [{name: a, include: [{visibility: public}]}]`,
+			err: "rule 0(a): invalid visibility public, exported or unexported expected"},
+		{content: `rules: [{exclude: [{funcs: ["("]}]}]`, err: "rule 0(): invalid func pattern (: error parsing regexp: missing closing ): `(`"},
+		{content: `{"rule": []}`, isJSON: true, err: `json: unknown field "rule"`},
+	}
+	for _, c := range invalids {
+		_, err := Parse([]byte(c.content), c.isJSON)
+		assert.Error(t, err, c.err)
+	}
+}
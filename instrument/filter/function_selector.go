@@ -2,6 +2,8 @@ package filter
 
 import (
 	"go/ast"
+	goparser "go/parser"
+	"go/types"
 	"regexp"
 	"strings"
 )
@@ -9,16 +11,61 @@ import (
 // FuncFilter source function filter
 type FuncFilter func(*ast.FuncDecl) bool
 
-var (
-	FuncNameExcludeExpr *regexp.Regexp
-	filters             = []FuncFilter{negateFunc(excludeCommentFilter), negateFunc(funcNameExcludeFilter)}
-	defaultFuncFilter   = filterBundle(filters).matchSourceFunc
-	// DefaultFuncFilter get unified function filter to select func
-	DefaultFuncFilter = func() FuncFilter {
-		return defaultFuncFilter
-	}
+const (
+	excludeComment = "//instrument:exclude"
+	includeComment = "//instrument:include"
+	patchesComment = "//instrument:patches="
 )
 
+// DefaultFuncFilter create function filter selecting functions by directives of doc comments only, a new filter is
+// returned on each call, pass it to rewriter by Options.Filter
+func DefaultFuncFilter() FuncFilter {
+	return NewFuncFilter(nil, nil)
+}
+
+// NewFuncFilter create function filter of directives and name patterns, functions whose names match include
+// pattern and do not match exclude pattern are selected, nil pattern is ignored. functions with include comment are
+// selected regardless of name patterns, and exclude comment always wins.
+// filters have no mutable state, so they can be shared by goroutines.
+func NewFuncFilter(include, exclude *regexp.Regexp) FuncFilter {
+	return All(Not(excludeCommentFilter), Any(includeCommentFilter, NameFilter(include, exclude)))
+}
+
+// NameFilter select functions whose names match include pattern and do not match exclude pattern,
+// nil pattern is ignored
+func NameFilter(include, exclude *regexp.Regexp) FuncFilter {
+	return func(decl *ast.FuncDecl) bool {
+		if exclude != nil && matchName(exclude, decl.Name.Name) {
+			return false
+		}
+		return include == nil || matchName(include, decl.Name.Name)
+	}
+}
+
+// All function is selected if it is selected by all filters
+func All(fs ...FuncFilter) FuncFilter {
+	return filterBundle(fs).matchSourceFunc
+}
+
+// Any function is selected if it is selected by any filter
+func Any(fs ...FuncFilter) FuncFilter {
+	return func(decl *ast.FuncDecl) bool {
+		for _, f := range fs {
+			if f(decl) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not function is selected if it is not selected by f
+func Not(f FuncFilter) FuncFilter {
+	return func(decl *ast.FuncDecl) bool {
+		return !f(decl)
+	}
+}
+
 type filterBundle []FuncFilter
 
 func (f filterBundle) matchSourceFunc(decl *ast.FuncDecl) bool {
@@ -30,39 +77,109 @@ func (f filterBundle) matchSourceFunc(decl *ast.FuncDecl) bool {
 	return true
 }
 
-func negateFunc(f FuncFilter) FuncFilter {
-	return func(decl *ast.FuncDecl) bool {
-		return !f(decl)
-	}
+// HasExcludeDirective function is excluded by doc comment `//instrument:exclude`
+func HasExcludeDirective(decl *ast.FuncDecl) bool {
+	return excludeCommentFilter(decl)
 }
 
 func excludeCommentFilter(decl *ast.FuncDecl) bool {
-	const excludeComment = "//instrument:exclude"
-	if decl.Doc == nil {
-		return false
+	_, ok := findDirective(decl, excludeComment)
+	return ok
+}
+
+func includeCommentFilter(decl *ast.FuncDecl) bool {
+	_, ok := findDirective(decl, includeComment)
+	return ok
+}
+
+// PatchNamesDirective names of patch funcs applied to function by doc comment `//instrument:patches=Name1,Name2`,
+// ok is false if function has no such directive
+func PatchNamesDirective(decl *ast.FuncDecl) (names []string, ok bool) {
+	value, ok := findDirective(decl, patchesComment)
+	if !ok {
+		return nil, false
 	}
-	for _, comment := range decl.Doc.List {
-		if strings.HasPrefix(comment.Text, excludeComment) {
-			return true
+	names = make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
 		}
 	}
-	return false
+	return names, true
 }
 
-func funcNameExcludeFilter(decl *ast.FuncDecl) bool {
-	if FuncNameExcludeExpr == nil {
-		return false
+// findDirective find directive in doc comment of function, value is the rest text after directive
+func findDirective(decl *ast.FuncDecl, directive string) (value string, ok bool) {
+	if decl.Doc == nil {
+		return "", false
+	}
+	for _, comment := range decl.Doc.List {
+		if strings.HasPrefix(comment.Text, directive) {
+			return strings.TrimSpace(strings.TrimPrefix(comment.Text, directive)), true
+		}
 	}
-	return matchName(FuncNameExcludeExpr, decl.Name.Name)
+	return "", false
 }
 
 func matchName(pat *regexp.Regexp, name string) bool {
 	return pat.MatchString(name)
 }
 
+// PatchKind kind of patch function, decided by patch function signature
+type PatchKind int
+
+const (
+	PatchKindUnknown PatchKind = iota
+	// PatchKindEntry patch body is executed on entry of source function, args can also be declared in lazy form
+	// `args func() []interface{}`, so params are boxed only when patch body calls it, descriptor param of
+	// FuncDescType can be declared before args
+	// 	ProcessFunc(spanName string, hasCtx bool, ctx gonativectx.Context, args ...interface{})
+	// 	ProcessFunc(spanName string, hasCtx bool, ctx gonativectx.Context, fn FuncDescType, args ...interface{})
+	PatchKindEntry
+	// PatchKindExit patch body is deferred and executed on return of source function,
+	// err is the last result of source function if its type is error, results are all results of source function,
+	// results can also be declared in lazy form `results func() []interface{}`, descriptor param of FuncDescType
+	// can be declared before results
+	// 	ExitFunc(spanName string, ctx gonativectx.Context, err error, results ...interface{})
+	// 	ExitFunc(spanName string, ctx gonativectx.Context, err error, fn FuncDescType, results ...interface{})
+	PatchKindExit
+	// PatchKindPanic patch body is deferred and executed only when source function panics, recovered is
+	// the recovered panic value, stack is the stack trace of panic, panic is re-raised after patch body.
+	// 	PanicFunc(spanName string, ctx gonativectx.Context, recovered interface{}, stack []byte)
+	PatchKindPanic
+)
+
+// FuncDescType type of descriptor param of entry and exit patch functions, static descriptor of every instrumented
+// function is generated as a package level var, ParamNames and ParamTypes are of params in args, types are
+// formatted as in source code, eg: context.Context, ...int
+const FuncDescType = `*struct {
+	Func       string
+	File       string
+	Line       int
+	ParamNames []string
+	ParamTypes []string
+}`
+
+var funcDescTypeString = types.ExprString(mustParseExpr(FuncDescType))
+
+// GetPatchKind get patch kind of function decl, PatchKindUnknown is returned if signature not matched
+func GetPatchKind(decl *ast.FuncDecl) PatchKind {
+	switch {
+	case matchInstrumentSignature(decl):
+		return PatchKindEntry
+	case matchExitSignature(decl):
+		return PatchKindExit
+	case matchPanicSignature(decl):
+		return PatchKindPanic
+	}
+	return PatchKindUnknown
+}
+
 // SelectInstrumentFuncDecls select instrument func decls
 func SelectInstrumentFuncDecls(decls []ast.Decl) []*ast.FuncDecl {
-	return SelectFuncDecls(decls, matchInstrumentSignature)
+	return SelectFuncDecls(decls, func(decl *ast.FuncDecl) bool {
+		return GetPatchKind(decl) != PatchKindUnknown
+	})
 }
 
 // SelectFuncDecls select func decls which match filter
@@ -79,37 +196,101 @@ func SelectFuncDecls(decls []ast.Decl, f FuncFilter) []*ast.FuncDecl {
 func matchInstrumentSignature(decl *ast.FuncDecl) bool {
 	// instrument function signature
 	// ProcessFunc(spanName string, hasCtx bool, ctx context.Context, args ...interface{})
-	params := decl.Type.Params.List
-	if len(decl.Type.Params.List) != 4 {
-		return false
-	}
-	if len(params[0].Names) != 1 || params[0].Type.(*ast.Ident).Name != "string" {
-		return false
-	}
-	if len(params[1].Names) != 1 || params[1].Type.(*ast.Ident).Name != "bool" {
+	return matchParams(decl, isIdentType("string"), isIdentType("bool"), isNativeCtxType, isArgsType) ||
+		matchParams(decl, isIdentType("string"), isIdentType("bool"), isNativeCtxType, IsFuncDescType, isArgsType)
+}
+
+func matchExitSignature(decl *ast.FuncDecl) bool {
+	// exit function signature
+	// ExitFunc(spanName string, ctx context.Context, err error, results ...interface{})
+	return matchParams(decl, isIdentType("string"), isNativeCtxType, isIdentType("error"), isArgsType) ||
+		matchParams(decl, isIdentType("string"), isNativeCtxType, isIdentType("error"), IsFuncDescType, isArgsType)
+}
+
+func matchPanicSignature(decl *ast.FuncDecl) bool {
+	// panic function signature
+	// PanicFunc(spanName string, ctx context.Context, recovered interface{}, stack []byte)
+	return matchParams(decl, isIdentType("string"), isNativeCtxType, isEmptyInterface, isByteSlice)
+}
+
+// matchParams every param has exactly one name, and param types are matched one by one
+func matchParams(decl *ast.FuncDecl, typeMatchers ...func(ast.Expr) bool) bool {
+	if decl.Recv != nil || decl.Body == nil {
 		return false
 	}
-	if len(params[2].Names) != 1 {
+	params := decl.Type.Params.List
+	if len(params) != len(typeMatchers) {
 		return false
 	}
-	if sel, ok := params[2].Type.(*ast.SelectorExpr); !ok ||
-		sel.X.(*ast.Ident).Name != "gonativectx" || sel.Sel.Name != "Context" {
-		return false
+	for i, param := range params {
+		if len(param.Names) != 1 || !typeMatchers[i](param.Type) {
+			return false
+		}
 	}
-	// args ...interface{}
-	if len(params[3].Names) != 1 {
-		return false
+	return true
+}
+
+func isIdentType(name string) func(ast.Expr) bool {
+	return func(t ast.Expr) bool {
+		ident, ok := t.(*ast.Ident)
+		return ok && ident.Name == name
 	}
-	t, ok := params[3].Type.(*ast.Ellipsis)
+}
+
+// isNativeCtxType gonativectx.Context
+func isNativeCtxType(t ast.Expr) bool {
+	sel, ok := t.(*ast.SelectorExpr)
 	if !ok {
 		return false
 	}
-	it, ok := t.Elt.(*ast.InterfaceType)
-	if !ok {
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == "gonativectx" && sel.Sel.Name == "Context"
+}
+
+// isArgsType ...interface{}, or lazy form func() []interface{}
+func isArgsType(t ast.Expr) bool {
+	return isEmptyInterfaceEllipsis(t) || IsLazyArgsType(t)
+}
+
+// IsLazyArgsType func() []interface{}, lazy form of args and results params of patch functions
+func IsLazyArgsType(t ast.Expr) bool {
+	ft, ok := t.(*ast.FuncType)
+	if !ok || len(ft.Params.List) != 0 || ft.Results == nil || len(ft.Results.List) != 1 ||
+		len(ft.Results.List[0].Names) > 0 {
 		return false
 	}
-	if len(it.Methods.List) != 0 {
-		return false
+	at, ok := ft.Results.List[0].Type.(*ast.ArrayType)
+	return ok && at.Len == nil && isEmptyInterface(at.Elt)
+}
+
+// IsFuncDescType type of func descriptor param, fields must be the same as FuncDescType
+func IsFuncDescType(t ast.Expr) bool {
+	_, ok := t.(*ast.StarExpr)
+	return ok && types.ExprString(t) == funcDescTypeString
+}
+
+func mustParseExpr(x string) ast.Expr {
+	expr, err := goparser.ParseExpr(x)
+	if err != nil {
+		panic(err)
 	}
-	return true
+	return expr
+}
+
+// isEmptyInterfaceEllipsis ...interface{}
+func isEmptyInterfaceEllipsis(t ast.Expr) bool {
+	ellipsis, ok := t.(*ast.Ellipsis)
+	return ok && isEmptyInterface(ellipsis.Elt)
+}
+
+// isEmptyInterface interface{}
+func isEmptyInterface(t ast.Expr) bool {
+	it, ok := t.(*ast.InterfaceType)
+	return ok && len(it.Methods.List) == 0
+}
+
+// isByteSlice []byte
+func isByteSlice(t ast.Expr) bool {
+	at, ok := t.(*ast.ArrayType)
+	return ok && at.Len == nil && isIdentType("byte")(at.Elt)
 }
@@ -1,9 +1,11 @@
 package filter
 
 import (
+	"go/ast"
 	"regexp"
 	"testing"
 
+	"github.com/jattle/go-instrumentation/instrument/parser"
 	"gotest.tools/assert"
 )
 
@@ -21,3 +23,107 @@ func TestMatchName(t *testing.T) {
 		}
 	}
 }
+
+func TestGetPatchKind(t *testing.T) {
+	content := `package patch
+
+import (
+	gonativectx "context"
+)
+
+func Entry(spanName string, hasCtx bool, ctx gonativectx.Context, args ...interface{}) {}
+
+func Exit(spanName string, ctx gonativectx.Context, err error, results ...interface{}) {}
+
+func Panic(spanName string, _ gonativectx.Context, recovered interface{}, stack []byte) {}
+
+func LazyEntry(spanName string, hasCtx bool, ctx gonativectx.Context, args func() []interface{}) {}
+
+func LazyExit(spanName string, ctx gonativectx.Context, err error, results func() []interface{}) {}
+
+func DescEntry(spanName string, _ bool, _ gonativectx.Context, fn *struct {
+	Func       string
+	File       string
+	Line       int
+	ParamNames []string
+	ParamTypes []string
+}, args ...interface{}) {}
+
+func DescExit(spanName string, _ gonativectx.Context, _ error, fn *struct {
+	Func       string
+	File       string
+	Line       int
+	ParamNames []string
+	ParamTypes []string
+}, _ func() []interface{}) {}
+
+func helper4(spanName string, _ bool, _ gonativectx.Context, fn *struct{ Func string }, args ...interface{}) {}
+
+func helper3(spanName string, hasCtx bool, ctx gonativectx.Context, args func(int) []interface{}) {}
+
+func helper(a []int, b map[string]int, c func(), d ...int) {}
+
+func helper2(spanName string, hasCtx bool) {}
+`
+	meta, err := parser.ParseContent("patch.go", []byte(content))
+	assert.NilError(t, err)
+	wants := map[string]PatchKind{
+		"Entry":     PatchKindEntry,
+		"Exit":      PatchKindExit,
+		"Panic":     PatchKindPanic,
+		"LazyEntry": PatchKindEntry,
+		"LazyExit":  PatchKindExit,
+		"DescEntry": PatchKindEntry,
+		"DescExit":  PatchKindExit,
+		"helper4":   PatchKindUnknown,
+		"helper":    PatchKindUnknown,
+		"helper2":   PatchKindUnknown,
+		"helper3":   PatchKindUnknown,
+	}
+	decls := SelectFuncDecls(meta.ASTFile.Decls, func(*ast.FuncDecl) bool { return true })
+	assert.Equal(t, len(decls), len(wants))
+	for _, decl := range decls {
+		assert.Equal(t, GetPatchKind(decl), wants[decl.Name.Name], decl.Name.Name)
+	}
+	assert.Equal(t, len(SelectInstrumentFuncDecls(meta.ASTFile.Decls)), 7)
+}
+
+func TestNewFuncFilter(t *testing.T) {
+	content := `package main
+
+func Handle() {}
+
+func helper() {}
+
+//instrument:include
+func mustInclude() {}
+
+//instrument:exclude
+//instrument:include
+func excluded() {}
+
+//instrument:patches=Entry, Exit
+func Patched() {}
+`
+	meta, err := parser.ParseContent("source.go", []byte(content))
+	assert.NilError(t, err)
+	funcFilter := NewFuncFilter(regexp.MustCompile("^[A-Z]"), regexp.MustCompile("^Patched$"))
+	var selected []string
+	for _, decl := range SelectFuncDecls(meta.ASTFile.Decls, funcFilter) {
+		selected = append(selected, decl.Name.Name)
+	}
+	assert.DeepEqual(t, selected, []string{"Handle", "mustInclude"})
+	decls := SelectFuncDecls(meta.ASTFile.Decls, func(*ast.FuncDecl) bool { return true })
+	names, ok := PatchNamesDirective(decls[len(decls)-1])
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, names, []string{"Entry", "Exit"})
+	_, ok = PatchNamesDirective(decls[0])
+	assert.Assert(t, !ok)
+	// filters can be composed
+	selected = selected[:0]
+	for _, decl := range SelectFuncDecls(meta.ASTFile.Decls, All(DefaultFuncFilter(),
+		Not(NameFilter(regexp.MustCompile("^h"), nil)))) {
+		selected = append(selected, decl.Name.Name)
+	}
+	assert.DeepEqual(t, selected, []string{"Handle", "mustInclude", "Patched"})
+}
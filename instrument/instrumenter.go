@@ -0,0 +1,278 @@
+package instrument
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/jattle/go-instrumentation/instrument/config"
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/instrument/rewriter"
+)
+
+// Options options of instrumentation, every Instrumenter owns its options, so instrumenters with different options
+// can be used in one process.
+type Options struct {
+	// PatchFiles patch files to apply, patch files of config patch sets are loaded too
+	PatchFiles []string
+	// Patches parsed patch files to apply, eg: patches embedded in binary
+	Patches []parser.FileMeta
+	// IncludeFuncExpr only functions whose names match are instrumented if not nil
+	IncludeFuncExpr *regexp.Regexp
+	// ExcludeFuncExpr functions whose names match are not instrumented if not nil
+	ExcludeFuncExpr *regexp.Regexp
+	// Filters extra filters of source function declarations, functions must be selected by all filters
+	Filters []filter.FuncFilter
+	// Config rules selecting functions to instrument and patch sets applied to them, validated by NewInstrumenter
+	Config *config.Config
+	// FuncLit instrument function literals too
+	FuncLit bool
+	// TypeParams include type params in names of generic functions, eg: (*Map[K,V]).Get
+	TypeParams bool
+	// SpanNameTemplate text/template of span names executed with rewriter.SpanNameData,
+	// eg: {{.ImportPath}}.{{.Receiver}}.{{.Func}}, span names are like source.go-main.(*T).Foo if empty
+	SpanNameTemplate string
+	// Naming naming strategy of patch vars, rewriter.NamingHash by default
+	Naming rewriter.NamingStrategy
+	// CtxAccessors accessors of params which carry context.Context, merged with rewriter.DefaultCtxAccessors()
+	CtxAccessors map[string]rewriter.CtxAccessor
+	// TypeCheck load type information of source packages to detect context params
+	TypeCheck bool
+	// Verify parse and type check instrumented source before saving, file fails with *rewriter.VerifyError
+	// naming the patch whose injected code does not compile
+	Verify bool
+	// Rollback keep source file uninstrumented if verification fails, the error is reported as a warning
+	Rollback bool
+	// Remove remove injected code from source files instead of instrumenting them, patches are not needed
+	Remove bool
+	// DryRun nothing is saved, instrumentation results are returned only
+	DryRun bool
+	// Output output file of InstrumentFile, or output dir of InstrumentDir and InstrumentPackages where
+	// instrumented files are stored with the same paths relative to working dir, source files are replaced if empty
+	Output string
+}
+
+// Instrumenter apply patches to source files, patches are parsed only once when instrumenter is created,
+// it is safe to instrument source files concurrently by one instrumenter.
+type Instrumenter struct {
+	opts rewriter.Options
+	// patchFiles absolute paths of patch files, which are not instrumented by patterns, eg: patches in ./...
+	patchFiles map[string]struct{}
+	typeCheck  bool
+	remove     bool
+	dryRun     bool
+	output     string
+}
+
+// NewInstrumenter parse patches and build filter chain of options
+func NewInstrumenter(opts Options) (*Instrumenter, error) {
+	i := &Instrumenter{typeCheck: opts.TypeCheck, remove: opts.Remove, dryRun: opts.DryRun, output: opts.Output}
+	if opts.Remove {
+		return i, nil
+	}
+	patchFiles := opts.PatchFiles
+	if opts.Config != nil {
+		// patterns of config created by code are compiled by validation
+		if err := opts.Config.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+		patchFiles = append(patchFiles[:len(patchFiles):len(patchFiles)], opts.Config.PatchFiles()...)
+	}
+	patches := make([]parser.FileMeta, 0, len(patchFiles)+len(opts.Patches))
+	for _, f := range patchFiles {
+		meta, err := parser.ParseFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("parse patch %s failed: %w", f, err)
+		}
+		patches = append(patches, meta)
+	}
+	patches = append(patches, opts.Patches...)
+	i.patchFiles = make(map[string]struct{}, len(patches))
+	for _, patch := range patches {
+		if abs, err := filepath.Abs(patch.FileName); err == nil {
+			i.patchFiles[abs] = struct{}{}
+		}
+	}
+	patchSet, err := rewriter.NewPatchSetWithNaming(patches, opts.Naming)
+	if err != nil {
+		return nil, err
+	}
+	var spanNameTemplate *template.Template
+	if opts.SpanNameTemplate != "" {
+		if spanNameTemplate, err = rewriter.ParseSpanNameTemplate(opts.SpanNameTemplate); err != nil {
+			return nil, err
+		}
+	}
+	accessors := rewriter.DefaultCtxAccessors()
+	for typeName, accessor := range opts.CtxAccessors {
+		accessors[typeName] = accessor
+	}
+	filters := append([]filter.FuncFilter{filter.NewFuncFilter(opts.IncludeFuncExpr, opts.ExcludeFuncExpr)},
+		opts.Filters...)
+	i.opts = rewriter.Options{
+		PatchSet:         patchSet,
+		Filter:           filter.All(filters...),
+		FuncRules:        opts.Config,
+		FuncLit:          opts.FuncLit,
+		TypeParams:       opts.TypeParams,
+		SpanNameTemplate: spanNameTemplate,
+		CtxAccessors:     accessors,
+		Verify:           opts.Verify,
+		Rollback:         opts.Rollback,
+	}
+	return i, nil
+}
+
+// PatchSet patches applied by instrumenter, nil in remove mode
+func (i *Instrumenter) PatchSet() *rewriter.PatchSet {
+	return i.opts.PatchSet
+}
+
+// RewriteSourceFile apply patches to source file, or remove injected code in remove mode,
+// content of source is replaced with instrumentation result
+func (i *Instrumenter) RewriteSourceFile(source *parser.FileMeta) error {
+	_, err := i.rewrite(source, newSourceLoader(i.typeCheck))
+	return err
+}
+
+// rewrite source file, rewritten source is type checked by checker of loader if verification is enabled
+func (i *Instrumenter) rewrite(source *parser.FileMeta, loader *sourceLoader) (rewriter.FileResult, error) {
+	if i.remove {
+		return rewriter.FileResult{}, rewriter.StripInstrumentation(source)
+	}
+	opts := i.opts
+	if opts.Verify {
+		opts.TypeChecker = loader.checker().CheckFile
+	}
+	return rewriter.RewriteSourceFileWithResult(source, opts)
+}
+
+// InstrumentFile instrument one source file, result is saved to Output or source file unless in dry run mode,
+// returned error is the same as Err of result.
+func (i *Instrumenter) InstrumentFile(filename string) (FileResult, error) {
+	output := i.output
+	if output == "" {
+		output = filename
+	}
+	result := i.instrumentFile(newSourceLoader(i.typeCheck), filename, output)
+	return result, result.Err
+}
+
+// InstrumentDir instrument go files of dir, sub dirs are not included, use InstrumentPackages with dir/...
+// to instrument dir recursively.
+func (i *Instrumenter) InstrumentDir(dir string) (Result, error) {
+	return i.InstrumentPackages(dir)
+}
+
+// InstrumentPackages instrument go files matched by patterns, pattern is a go file, dir or dir ends with /...,
+// see parser.ExpandSourcePatterns, patch files matched are not instrumented. error is returned only if patterns
+// can not be expanded, errors of source files are recorded in results, see Result.Err.
+func (i *Instrumenter) InstrumentPackages(patterns ...string) (Result, error) {
+	files, err := parser.ExpandSourcePatterns(patterns...)
+	if err != nil {
+		return Result{}, err
+	}
+	loader := newSourceLoader(i.typeCheck)
+	result := Result{Files: make([]FileResult, 0, len(files))}
+	for _, filename := range files {
+		if i.isPatchFile(filename) {
+			continue
+		}
+		output, err := i.outputOf(filename)
+		if err != nil {
+			result.Files = append(result.Files, FileResult{Filename: filename, Err: err})
+			continue
+		}
+		result.Files = append(result.Files, i.instrumentFile(loader, filename, output))
+	}
+	return result, nil
+}
+
+// isPatchFile whether file is one of patch files applied by instrumenter
+func (i *Instrumenter) isPatchFile(filename string) bool {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return false
+	}
+	_, ok := i.patchFiles[abs]
+	return ok
+}
+
+// outputOf output file of source file matched by patterns, instrumented files are stored with same relative path
+// of source files in output dir
+func (i *Instrumenter) outputOf(filename string) (string, error) {
+	if i.output == "" {
+		return filename, nil
+	}
+	rel := filename
+	if filepath.IsAbs(filename) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if rel, err = filepath.Rel(cwd, filename); err != nil {
+			return "", err
+		}
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("source %s is out of working dir, replace source files instead", filename)
+	}
+	return filepath.Join(i.output, rel), nil
+}
+
+// instrumentFile rewrite one source file and save result to output unless in dry run mode
+func (i *Instrumenter) instrumentFile(loader *sourceLoader, filename, output string) (result FileResult) {
+	result.Filename = filename
+	defer func() {
+		if e := recover(); e != nil {
+			buf := [1024]byte{}
+			sbuf := buf[:runtime.Stack(buf[:], false)]
+			result.Err = fmt.Errorf("auto instrumentation exec failed, err: %+v, stack: %s", e, string(sbuf))
+		}
+	}()
+	sourceMeta, warnings, err := loader.load(filename)
+	result.Warnings = warnings
+	if err != nil {
+		result.Err = err
+		return
+	}
+	result.Original = sourceMeta.Content
+	rewritten, err := i.rewrite(&sourceMeta, loader)
+	result.Funcs, result.Skipped = rewritten.Funcs, rewritten.Skipped
+	if err != nil {
+		result.Err = fmt.Errorf("rewrite source failed: %w", err)
+		return
+	}
+	if rewritten.VerifyErr != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("instrumentation of %s is rolled back, err: %v",
+			filename, rewritten.VerifyErr))
+	}
+	result.Content = sourceMeta.Content
+	result.Changed = !bytes.Equal(result.Original, result.Content)
+	// nothing to do with unchanged file in replace mode
+	if i.dryRun || (!result.Changed && output == filename) {
+		return
+	}
+	if err = saveFile(output, result.Content); err != nil {
+		result.Err = fmt.Errorf("save instrumentation failed: %w", err)
+		return
+	}
+	result.Output = output
+	return
+}
+
+func saveFile(filename string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0775); err != nil {
+		return fmt.Errorf("mkdir for file %s failed: %w", filename, err)
+	}
+	if err := os.WriteFile(filename, content, 0664); err != nil {
+		return fmt.Errorf("write file %s failed: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package instrument
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument/config"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/instrument/rewriter"
+	"gotest.tools/assert"
+)
+
+const testPatchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName)
+}
+`
+
+// markerBegin begin marker of code injected by Entry
+const markerBegin = "//instrument:begin Entry"
+
+const testSourceContent = `package main
+
+func Handle() {
+	go func() {}()
+}
+
+func helper() {}
+`
+
+func TestInstrumenterConcurrent(t *testing.T) {
+	patch, err := parser.ParseContent("patch.go", []byte(testPatchContent))
+	assert.NilError(t, err)
+	cases := []struct {
+		opts  Options
+		spans []string
+	}{
+		{opts: Options{}, spans: []string{"main.Handle", "main.helper"}},
+		{opts: Options{IncludeFuncExpr: regexp.MustCompile("^[A-Z]")}, spans: []string{"main.Handle"}},
+		{opts: Options{ExcludeFuncExpr: regexp.MustCompile("^[A-Z]")}, spans: []string{"main.helper"}},
+		{opts: Options{FuncLit: true}, spans: []string{"main.Handle", "main.Handle.func1", "main.helper"}},
+	}
+	var wg sync.WaitGroup
+	for _, c := range cases {
+		c.opts.Patches = []parser.FileMeta{patch}
+		instrumenter, err := NewInstrumenter(c.opts)
+		assert.NilError(t, err)
+		// instrumenters with different options and one instrumenter used by goroutines do not interfere
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(spans []string) {
+				defer wg.Done()
+				source, err := parser.ParseContent("source.go", []byte(testSourceContent))
+				assert.Check(t, err)
+				assert.Check(t, instrumenter.RewriteSourceFile(&source))
+				content := string(source.Content)
+				assert.Check(t, strings.Count(content, markerBegin) == len(spans), content)
+				for _, span := range spans {
+					assert.Check(t, strings.Contains(content, "\"source.go-"+span+"\""), content)
+				}
+			}(c.spans)
+		}
+	}
+	wg.Wait()
+}
+
+func TestInstrumentPackages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"patch/patch.go": testPatchContent,
+		"a/a.go":         testSourceContent,
+		"a/b/b.go":       "package b\n\n//instrument:exclude\nfunc Excluded() {}\n\nfunc Decl()\n",
+		"a/c.go":         "package main\n\nfunc broken( {}\n",
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		assert.NilError(t, os.WriteFile(filename, []byte(content), 0644))
+	}
+	output := filepath.Join(dir, "output")
+	instrumenter, err := NewInstrumenter(Options{PatchFiles: []string{filepath.Join(dir, "patch/patch.go")},
+		DryRun: true})
+	assert.NilError(t, err)
+	result, err := instrumenter.InstrumentPackages(filepath.Join(dir, "a/..."))
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Files), 3)
+	assert.DeepEqual(t, result.ChangedFiles(), []string{filepath.Join(dir, "a/a.go")})
+	assert.Equal(t, len(result.Failed()), 1)
+	assert.ErrorContains(t, result.Err(), "a/c.go")
+	a, b := result.Files[0], result.Files[1]
+	assert.Equal(t, len(a.Funcs), 2)
+	assert.Equal(t, a.Funcs[0].Name, "Handle")
+	assert.DeepEqual(t, a.Funcs[0].Patches, []string{"Entry"})
+	assert.Equal(t, len(b.Funcs), 0)
+	assert.Equal(t, len(b.Skipped), 2)
+	assert.Equal(t, b.Skipped[0].SkipReason, rewriter.SkipReasonExcludeComment)
+	assert.Equal(t, b.Skipped[1].SkipReason, rewriter.SkipReasonNoFuncBody)
+	// nothing is saved in dry run mode
+	assert.Equal(t, a.Output, "")
+	content, err := os.ReadFile(filepath.Join(dir, "a/a.go"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(content), testSourceContent)
+	// patch files matched by patterns are not instrumented
+	result, err = instrumenter.InstrumentPackages(filepath.Join(dir, "..."))
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Files), 3)
+	for _, f := range result.Files {
+		assert.Assert(t, f.Filename != filepath.Join(dir, "patch/patch.go"))
+	}
+
+	instrumenter, err = NewInstrumenter(Options{PatchFiles: []string{filepath.Join(dir, "patch/patch.go")},
+		Output: output})
+	assert.NilError(t, err)
+	wd, err := os.Getwd()
+	assert.NilError(t, err)
+	assert.NilError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+	result, err = instrumenter.InstrumentDir("a")
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Files), 2)
+	assert.Equal(t, result.Files[0].Output, filepath.Join(output, "a/a.go"))
+	saved, err := os.ReadFile(result.Files[0].Output)
+	assert.NilError(t, err)
+	assert.Equal(t, string(saved), string(result.Files[0].Content))
+	// only changed files are replaced by overlay
+	overlay, err := NewOverlay(result)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, overlay.Replace, map[string]string{filepath.Join(dir, "a/a.go"): result.Files[0].Output})
+	// source file is replaced if output is not provided
+	instrumenter, err = NewInstrumenter(Options{PatchFiles: []string{filepath.Join(dir, "patch/patch.go")}})
+	assert.NilError(t, err)
+	fileResult, err := instrumenter.InstrumentFile("a/a.go")
+	assert.NilError(t, err)
+	assert.Equal(t, fileResult.Output, "a/a.go")
+	saved, err = os.ReadFile("a/a.go")
+	assert.NilError(t, err)
+	assert.Equal(t, string(saved), string(fileResult.Content))
+}
+
+func TestNewInstrumenterConfig(t *testing.T) {
+	patch, err := parser.ParseContent("patch.go", []byte(testPatchContent))
+	assert.NilError(t, err)
+	// config created by code is validated, so its func patterns are compiled
+	cfg := &config.Config{Rules: []config.Rule{{Exclude: []config.Selector{{Funcs: []string{"^helper$"}}}}}}
+	instrumenter, err := NewInstrumenter(Options{Patches: []parser.FileMeta{patch}, Config: cfg, DryRun: true})
+	assert.NilError(t, err)
+	filename := filepath.Join(t.TempDir(), "source.go")
+	assert.NilError(t, os.WriteFile(filename, []byte(testSourceContent), 0644))
+	result, err := instrumenter.InstrumentFile(filename)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Funcs), 1)
+	assert.Equal(t, result.Funcs[0].Name, "Handle")
+	assert.Equal(t, result.Skipped[0].SkipReason, rewriter.SkipReasonNoRule)
+
+	cfg.Rules[0].Exclude[0].Funcs = []string{"("}
+	_, err = NewInstrumenter(Options{Patches: []parser.FileMeta{patch}, Config: cfg})
+	assert.ErrorContains(t, err, "invalid config: rule 0(): invalid func pattern (")
+}
+
+func TestNewReport(t *testing.T) {
+	patch, err := parser.ParseContent("patch.go", []byte(testPatchContent))
+	assert.NilError(t, err)
+	invalid, err := parser.ParseContent("invalid.go", []byte("package patch\n\nfunc helper() {}\n"))
+	assert.NilError(t, err)
+	instrumenter, err := NewInstrumenter(Options{Patches: []parser.FileMeta{patch, invalid},
+		ExcludeFuncExpr: regexp.MustCompile("^helper$"), DryRun: true})
+	assert.NilError(t, err)
+	filename := filepath.Join(t.TempDir(), "source.go")
+	assert.NilError(t, os.WriteFile(filename, []byte(testSourceContent+`
+//instrument:exclude
+func excluded() {}
+
+type Pair[K comparable, V any] struct{}
+
+func (p *Pair[K, V]) Key() {}
+`), 0644))
+	fileResult, err := instrumenter.InstrumentFile(filename)
+	assert.NilError(t, err)
+	report := NewReport(instrumenter.PatchSet(), Result{Files: []FileResult{fileResult}})
+	assert.DeepEqual(t, report.Summary, ReportSummary{Files: 1, Changed: 1, Funcs: 4, Instrumented: 2, Skipped: 2,
+		InvalidPatches: 1})
+	assert.DeepEqual(t, report.Patches, []PatchReport{{File: "patch.go", Funcs: []string{"Entry"}},
+		{File: "invalid.go", Error: "instrument func decl not found"}})
+	funcs := report.Files[0].Funcs
+	assert.DeepEqual(t, funcs[0], FuncReport{Name: "Handle", SpanName: "source.go-main.Handle", Line: 3, Column: 1,
+		Patches: []string{"Entry"}})
+	for i, reason := range []string{rewriter.SkipReasonFiltered, rewriter.SkipReasonExcludeComment} {
+		assert.Equal(t, funcs[i+1].SkipReason, reason)
+	}
+	assert.Equal(t, funcs[3].Name, "(*Pair).Key")
+	assert.DeepEqual(t, funcs[3].Patches, []string{"Entry"})
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	assert.NilError(t, report.WriteFile(reportFile))
+	content, err := os.ReadFile(reportFile)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(content), `"skip_reason": "excluded by //instrument:exclude comment"`))
+}
+
+func TestNewReportFailedFile(t *testing.T) {
+	patch, err := parser.ParseContent("patch.go", []byte(testPatchContent))
+	assert.NilError(t, err)
+	instrumenter, err := NewInstrumenter(Options{Patches: []parser.FileMeta{patch}, DryRun: true})
+	assert.NilError(t, err)
+	dir := t.TempDir()
+	// fmt referenced by patch is shadowed by param of b, so file fails after a is instrumented
+	failed := filepath.Join(dir, "failed.go")
+	assert.NilError(t, os.WriteFile(failed, []byte("package main\n\nfunc a() {}\n\nfunc b(fmt string) {}\n"),
+		0644))
+	ok := filepath.Join(dir, "ok.go")
+	assert.NilError(t, os.WriteFile(ok, []byte(testSourceContent), 0644))
+	result, err := instrumenter.InstrumentPackages(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Files), 2)
+	assert.ErrorContains(t, result.Files[0].Err, "package fmt referenced by patch Entry is shadowed by fmt")
+	assert.Equal(t, len(result.Files[0].Funcs), 0)
+	report := NewReport(instrumenter.PatchSet(), result)
+	assert.DeepEqual(t, report.Summary, ReportSummary{Files: 2, Changed: 1, Failed: 1, Funcs: 2, Instrumented: 2})
+	assert.DeepEqual(t, report.Files[0].Funcs, []FuncReport{})
+	// funcs of failed file are not reported even if results are built by caller
+	result.Files[0].Funcs = []rewriter.FuncResult{{Name: "a", Patches: []string{"Entry"}}}
+	assert.DeepEqual(t, NewReport(instrumenter.PatchSet(), result).Summary, report.Summary)
+}
+
+func TestNewErrorReport(t *testing.T) {
+	_, err := NewInstrumenter(Options{PatchFiles: []string{filepath.Join(t.TempDir(), "missing.go")}})
+	assert.Assert(t, err != nil)
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	assert.NilError(t, NewErrorReport(err).WriteFile(reportFile))
+	content, err := os.ReadFile(reportFile)
+	assert.NilError(t, err)
+	var report Report
+	assert.NilError(t, json.Unmarshal(content, &report))
+	assert.Assert(t, strings.Contains(report.Error, "missing.go"), report.Error)
+	assert.DeepEqual(t, report.Files, []FileReport{})
+}
@@ -0,0 +1,47 @@
+package instrument
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Overlay overlay config of go build, go command reads files of Replace values instead of source files of keys,
+// so instrumented code is compiled by `go build -overlay=overlay.json` without touching source files.
+type Overlay struct {
+	Replace map[string]string `json:"Replace"`
+}
+
+// NewOverlay create overlay replacing changed source files of result with their saved outputs,
+// failed files and files not saved to another path are not replaced, paths are absolute.
+func NewOverlay(result Result) (Overlay, error) {
+	overlay := Overlay{Replace: make(map[string]string)}
+	for _, f := range result.Files {
+		if f.Err != nil || !f.Changed || f.Output == "" || f.Output == f.Filename {
+			continue
+		}
+		source, err := filepath.Abs(f.Filename)
+		if err != nil {
+			return Overlay{}, err
+		}
+		output, err := filepath.Abs(f.Output)
+		if err != nil {
+			return Overlay{}, err
+		}
+		overlay.Replace[source] = output
+	}
+	return overlay, nil
+}
+
+// WriteFile write overlay into file in json format
+func (o Overlay) WriteFile(filename string) error {
+	content, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal overlay failed: %w", err)
+	}
+	if err = os.WriteFile(filename, append(content, '\n'), 0664); err != nil {
+		return fmt.Errorf("write overlay %s failed: %w", filename, err)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"os"
 )
 
@@ -14,6 +15,10 @@ type FileMeta struct {
 	FSet     *token.FileSet
 	ASTFile  *ast.File
 	Content  []byte
+	// Pkg and TypesInfo are type information of package this file belongs to,
+	// only available if file is loaded by PackageLoader, otherwise they are nil.
+	Pkg       *types.Package
+	TypesInfo *types.Info
 }
 
 // ParseFile parse go source file
@@ -29,9 +34,13 @@ func ParseFile(filename string) (meta FileMeta, err error) {
 
 // ParseContent parse go source content
 func ParseContent(filename string, content []byte) (meta FileMeta, err error) {
+	return parseContent(token.NewFileSet(), filename, content)
+}
+
+func parseContent(fset *token.FileSet, filename string, content []byte) (meta FileMeta, err error) {
 	meta.FileName = filename
 	meta.Content = content
-	meta.FSet = token.NewFileSet()
+	meta.FSet = fset
 	if meta.ASTFile, err = parser.ParseFile(meta.FSet, filename, content, parser.ParseComments); err != nil {
 		err = fmt.Errorf("parse file %s failed: %w", filename, err)
 		return
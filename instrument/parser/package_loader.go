@@ -0,0 +1,141 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+)
+
+// PackageLoader parse go files of package dir and load type information of package,
+// all packages share one file set, and imported packages are type checked from source only once.
+type PackageLoader struct {
+	fset     *token.FileSet
+	importer types.Importer
+	// dir => parsed package files, files are only parsed once for checking
+	checked map[string]*parsedDir
+}
+
+type parsedDir struct {
+	importPath string
+	metas      []FileMeta
+}
+
+// NewPackageLoader create package loader
+func NewPackageLoader() *PackageLoader {
+	fset := token.NewFileSet()
+	return &PackageLoader{fset: fset, importer: importer.ForCompiler(fset, "source", nil),
+		checked: make(map[string]*parsedDir)}
+}
+
+// LoadDir parse non-test go files of dir matched by build constraints, and type check them,
+// type errors do not stop loading, partial type information is still available in returned metas,
+// and type errors are returned joined with metas.
+func (l *PackageLoader) LoadDir(dir string) (metas []FileMeta, err error) {
+	importPath, metas, err := l.parseDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	typesPkg, typeErrs := l.check(importPath, metas, info)
+	for i := range metas {
+		metas[i].Pkg = typesPkg
+		metas[i].TypesInfo = info
+	}
+	if len(typeErrs) > 0 {
+		errs := make([]error, 0, len(typeErrs))
+		for _, typeErr := range typeErrs {
+			errs = append(errs, typeErr)
+		}
+		err = fmt.Errorf("type check dir %s failed: %w", dir, errors.Join(errs...))
+	}
+	return metas, err
+}
+
+// CheckFile type check package of file with its content replaced, eg: to verify instrumented content before saving,
+// other files of package are read from disk and parsed only once. type errors of all package files are returned,
+// error is returned only if package can not be loaded. file excluded by build constraints is checked alone.
+func (l *PackageLoader) CheckFile(filename string, content []byte) ([]types.Error, error) {
+	dir := filepath.Dir(filename)
+	parsed, ok := l.checked[dir]
+	if !ok {
+		importPath, metas, err := l.parseDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		parsed = &parsedDir{importPath: importPath, metas: metas}
+		l.checked[dir] = parsed
+	}
+	meta, err := parseContent(l.fset, filename, content)
+	if err != nil {
+		return nil, err
+	}
+	metas := []FileMeta{meta}
+	for i, m := range parsed.metas {
+		if filepath.Clean(m.FileName) == filepath.Clean(filename) {
+			metas = append([]FileMeta{}, parsed.metas...)
+			metas[i] = meta
+			break
+		}
+	}
+	_, typeErrs := l.check(parsed.importPath, metas, nil)
+	return typeErrs, nil
+}
+
+// parseDir parse non-test go files of dir matched by build constraints, import path of package in module mode
+// is resolved by go.mod, since go/build only reports local import path "." for it
+func (l *PackageLoader) parseDir(dir string) (importPath string, metas []FileMeta, err error) {
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return "", nil, fmt.Errorf("import dir %s failed: %w", dir, err)
+	}
+	importPath = pkg.ImportPath
+	if build.IsLocalImport(importPath) {
+		if modPath := PackagePath(dir); modPath != "" {
+			importPath = modPath
+		}
+	}
+	filenames := append(append([]string{}, pkg.GoFiles...), pkg.CgoFiles...)
+	for _, name := range filenames {
+		filename := filepath.Join(dir, name)
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return "", nil, fmt.Errorf("read file %s failed: %w", filename, err)
+		}
+		meta, err := parseContent(l.fset, filename, content)
+		if err != nil {
+			return "", nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return importPath, metas, nil
+}
+
+// check type check files, type errors do not stop checking
+func (l *PackageLoader) check(importPath string, metas []FileMeta, info *types.Info) (*types.Package, []types.Error) {
+	files := make([]*ast.File, 0, len(metas))
+	for _, meta := range metas {
+		files = append(files, meta.ASTFile)
+	}
+	var typeErrs []types.Error
+	conf := types.Config{
+		Importer:    l.importer,
+		FakeImportC: true,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok {
+				typeErrs = append(typeErrs, typeErr)
+			}
+		},
+	}
+	typesPkg, _ := conf.Check(importPath, l.fset, files, info)
+	return typesPkg, typeErrs
+}
@@ -0,0 +1,32 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestLoadDirImportPath(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "svc", "user")
+	assert.NilError(t, os.MkdirAll(dir, 0775))
+	assert.NilError(t, os.WriteFile(filepath.Join(root, "go.mod"), []byte("module example.com/proj\n\ngo 1.20\n"),
+		0664))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "user.go"), []byte("package user\n\nfunc Get() {}\n"), 0664))
+
+	loader := NewPackageLoader()
+	metas, err := loader.LoadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(metas), 1)
+	assert.Equal(t, metas[0].Pkg.Path(), "example.com/proj/svc/user")
+	assert.Equal(t, metas[0].Pkg.Name(), "user")
+
+	// checked package is named by the same import path
+	typeErrs, err := loader.CheckFile(filepath.Join(dir, "user.go"),
+		[]byte("package user\n\nfunc Get() { _ = undefined }\n"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(typeErrs), 1)
+	assert.Equal(t, loader.checked[dir].importPath, "example.com/proj/svc/user")
+}
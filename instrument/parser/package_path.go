@@ -0,0 +1,37 @@
+package parser
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
+)
+
+// PackagePath get import path of package in dir, resolved by module path of the nearest go.mod,
+// empty string returned if no go.mod found
+func PackagePath(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	var elems []string
+	for {
+		if content, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			modulePath := modfile.ModulePath(content)
+			if modulePath == "" {
+				return ""
+			}
+			for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+				elems[i], elems[j] = elems[j], elems[i]
+			}
+			return path.Join(append([]string{modulePath}, elems...)...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		elems = append(elems, filepath.Base(dir))
+		dir = parent
+	}
+}
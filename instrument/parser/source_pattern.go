@@ -0,0 +1,114 @@
+package parser
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	recursivePatternSuffix = "/..."
+	goFileSuffix           = ".go"
+	goTestFileSuffix       = "_test.go"
+)
+
+// ExpandSourcePatterns expand source patterns into go source files, every pattern can be
+//  1. go source file, eg: a/b/c.go
+//  2. directory, only go files in this directory are selected, eg: a/b
+//  3. directory with suffix /..., go files in this directory and all its sub directories are selected, eg: ./...
+//
+// test files, testdata and vendor dirs, dirs starting with . or _, and sub dirs of nested modules(dirs with go.mod)
+// are ignored the same as go tool, returned files are deduplicated and sorted.
+func ExpandSourcePatterns(patterns ...string) ([]string, error) {
+	fileSet := make(map[string]struct{})
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		files, err := expandSourcePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			fileSet[f] = struct{}{}
+		}
+	}
+	files := make([]string, 0, len(fileSet))
+	for f := range fileSet {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func expandSourcePattern(pattern string) ([]string, error) {
+	if pattern == "..." || strings.HasSuffix(pattern, recursivePatternSuffix) {
+		dir := strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/")
+		if dir == "" {
+			dir = "."
+		}
+		return walkSourceDir(dir)
+	}
+	fi, err := os.Stat(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("stat source %s failed: %w", pattern, err)
+	}
+	if !fi.IsDir() {
+		return []string{filepath.Clean(pattern)}, nil
+	}
+	entries, err := os.ReadDir(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("read dir %s failed: %w", pattern, err)
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && IsSourceFile(entry.Name()) {
+			files = append(files, filepath.Join(pattern, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+func walkSourceDir(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && (isIgnoredDir(d.Name()) || isModuleDir(p)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && IsSourceFile(d.Name()) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk dir %s failed: %w", root, err)
+	}
+	return files, nil
+}
+
+// IsSourceFile report whether filename is a non-test go source file
+func IsSourceFile(filename string) bool {
+	base := filepath.Base(filename)
+	return strings.HasSuffix(base, goFileSuffix) && !strings.HasSuffix(base, goTestFileSuffix) &&
+		!strings.HasPrefix(base, ".") && !strings.HasPrefix(base, "_")
+}
+
+func isIgnoredDir(name string) bool {
+	return name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// isModuleDir whether dir is root of a module, packages of nested modules are not matched by ./... of outer module
+func isModuleDir(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "go.mod"))
+	return err == nil && !fi.IsDir()
+}
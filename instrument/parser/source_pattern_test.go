@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestExpandSourcePatterns(t *testing.T) {
+	root := t.TempDir()
+	for _, f := range []string{"go.mod", "a.go", "a_test.go", "_a.go", ".a.go", "a.txt", "b/b.go", "b/c/c.go",
+		"testdata/t.go", "vendor/v/v.go", ".git/g.go", "_tools/t.go", "nested/go.mod", "nested/n.go",
+		"nested/sub/s.go"} {
+		filename := filepath.Join(root, f)
+		assert.NilError(t, os.MkdirAll(filepath.Dir(filename), 0775))
+		assert.NilError(t, os.WriteFile(filename, []byte("package x\n"), 0664))
+	}
+	join := func(files ...string) []string {
+		for i, f := range files {
+			files[i] = filepath.Join(root, f)
+		}
+		return files
+	}
+	tests := []struct {
+		patterns []string
+		files    []string
+		err      string
+	}{
+		// files of pattern are selected even if they are not matched by dir patterns
+		{patterns: join("a_test.go"), files: join("a_test.go")},
+		{patterns: join("b"), files: join("b/b.go")},
+		{patterns: []string{filepath.Join(root, "...")}, files: join("a.go", "b/b.go", "b/c/c.go")},
+		{patterns: []string{filepath.Join(root, "b/..."), filepath.Join(root, "b/c"), " "},
+			files: join("b/b.go", "b/c/c.go")},
+		// nested module is matched by its own patterns
+		{patterns: []string{filepath.Join(root, "nested/...")}, files: join("nested/n.go", "nested/sub/s.go")},
+		{patterns: join("missing"), err: "stat source " + filepath.Join(root, "missing") + " failed"},
+	}
+	for _, tt := range tests {
+		files, err := ExpandSourcePatterns(tt.patterns...)
+		if tt.err != "" {
+			assert.ErrorContains(t, err, tt.err)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.DeepEqual(t, files, tt.files)
+	}
+}
@@ -2,23 +2,25 @@ package printer
 
 import (
 	"bytes"
+	"go/ast"
 	"go/printer"
 	"go/token"
 
 	"github.com/jattle/go-instrumentation/instrument/parser"
 )
 
+const (
+	tabWidth                = 8
+	printerNormalizeNumbers = 1 << 30
+	printerMode             = printer.UseSpaces | printer.TabIndent | printerNormalizeNumbers
+	// printerNormalizeNumbers means to canonicalize number literal prefixes
+)
+
 // PrintAstNode convert node to code
 // node: The node type must be *ast.File, *CommentedNode, []ast.Decl, []ast.Stmt,
 // or assignment-compatible to ast.Expr, ast.Decl, ast.Spec, or ast.Stmt.
 // indent: code indented by {indent} tab
 func PrintAstNode(node any, indent int) ([]byte, error) {
-	const (
-		tabWidth                = 8
-		printerNormalizeNumbers = 1 << 30
-		printerMode             = printer.UseSpaces | printer.TabIndent | printerNormalizeNumbers
-		// printerNormalizeNumbers means to canonicalize number literal prefixes
-	)
 	var buf bytes.Buffer
 	buf.WriteByte('\n')
 	fset := token.NewFileSet()
@@ -30,6 +32,23 @@ func PrintAstNode(node any, indent int) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// PrintBlockStmts convert stmts of block to code with comments, positions of block and comments are of fset,
+// braces of block are trimmed, and stmts are indented by {indent} tab
+func PrintBlockStmts(fset *token.FileSet, block *ast.BlockStmt, comments []*ast.CommentGroup,
+	indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	var config = printer.Config{Mode: printerMode, Tabwidth: tabWidth, Indent: indent - 1}
+	if err := config.Fprint(&buf, fset, &printer.CommentedNode{Node: block, Comments: comments}); err != nil {
+		return nil, err
+	}
+	code := buf.Bytes()
+	first, last := bytes.IndexByte(code, '\n'), bytes.LastIndexByte(code, '\n')
+	if first < 0 || first == last {
+		return nil, nil
+	}
+	return code[first+1 : last+1], nil
+}
+
 // PrintAstNodes print node array, T is node type suitable for PrintAsNode
 func PrintAstNodes[T any](nodes []T, indent int) ([]byte, error) {
 	buf := bytes.Buffer{}
@@ -0,0 +1,120 @@
+package instrument
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/jattle/go-instrumentation/instrument/rewriter"
+)
+
+// Report machine readable report of instrumentation, eg: for CI checking coverage of instrumentation
+type Report struct {
+	Summary ReportSummary `json:"summary"`
+	Patches []PatchReport `json:"patches"`
+	Files   []FileReport  `json:"files"`
+	// Error setup error stopping instrumentation before source files are instrumented, eg: config or patch files
+	// can not be loaded, no file is reported then
+	Error string `json:"error,omitempty"`
+}
+
+// ReportSummary counts of files and functions
+type ReportSummary struct {
+	Files        int `json:"files"`
+	Changed      int `json:"changed"`
+	Failed       int `json:"failed"`
+	Funcs        int `json:"funcs"`
+	Instrumented int `json:"instrumented"`
+	Skipped      int `json:"skipped"`
+	// InvalidPatches patch files ignored since no patch func found in them
+	InvalidPatches int `json:"invalid_patches"`
+}
+
+// PatchReport patch file and its patch funcs
+type PatchReport struct {
+	File  string   `json:"file"`
+	Funcs []string `json:"funcs,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// FileReport instrumentation result of source file
+type FileReport struct {
+	File     string       `json:"file"`
+	Output   string       `json:"output,omitempty"`
+	Changed  bool         `json:"changed"`
+	Funcs    []FuncReport `json:"funcs"`
+	Warnings []string     `json:"warnings,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// FuncReport instrumentation result of source function, functions are sorted by position
+type FuncReport struct {
+	Name     string `json:"name"`
+	SpanName string `json:"span_name,omitempty"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	// Patches names of patch funcs applied to function, empty if function is skipped
+	Patches    []string `json:"patches,omitempty"`
+	SkipReason string   `json:"skip_reason,omitempty"`
+}
+
+// NewReport create report of instrumentation result, patches of patch set are reported if it is not nil
+func NewReport(patchSet *rewriter.PatchSet, result Result) Report {
+	report := Report{Files: make([]FileReport, 0, len(result.Files))}
+	if patchSet != nil {
+		for i, patch := range patchSet.Patches {
+			if names := patchSet.FuncNames(i); len(names) > 0 {
+				report.Patches = append(report.Patches, PatchReport{File: patch.FileName, Funcs: names})
+			}
+		}
+		for _, invalid := range patchSet.Invalid {
+			report.Patches = append(report.Patches, PatchReport{File: invalid.FileName, Error: invalid.Err.Error()})
+		}
+		report.Summary.InvalidPatches = len(patchSet.Invalid)
+	}
+	for _, f := range result.Files {
+		fileReport := FileReport{File: f.Filename, Output: f.Output, Changed: f.Changed, Warnings: f.Warnings,
+			Funcs: make([]FuncReport, 0, len(f.Funcs)+len(f.Skipped))}
+		funcs := f.Funcs
+		if f.Err != nil {
+			// functions of failed file are not instrumented
+			fileReport.Error = f.Err.Error()
+			report.Summary.Failed++
+			funcs = nil
+		} else if f.Changed {
+			report.Summary.Changed++
+		}
+		for _, fn := range append(append([]rewriter.FuncResult{}, funcs...), f.Skipped...) {
+			fileReport.Funcs = append(fileReport.Funcs, FuncReport{Name: fn.Name, SpanName: fn.SpanName,
+				Line: fn.Pos.Line, Column: fn.Pos.Column, Patches: fn.Patches, SkipReason: fn.SkipReason})
+		}
+		sort.SliceStable(fileReport.Funcs, func(i, j int) bool {
+			a, b := fileReport.Funcs[i], fileReport.Funcs[j]
+			return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+		})
+		report.Summary.Files++
+		report.Summary.Funcs += len(fileReport.Funcs)
+		report.Summary.Instrumented += len(funcs)
+		report.Summary.Skipped += len(f.Skipped)
+		report.Files = append(report.Files, fileReport)
+	}
+	return report
+}
+
+// NewErrorReport create report of instrumentation failed to set up, so CI sees the failure instead of missing report
+func NewErrorReport(err error) Report {
+	return Report{Files: []FileReport{}, Error: err.Error()}
+}
+
+// WriteFile write report into file in json format
+func (r Report) WriteFile(filename string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal report failed: %w", err)
+	}
+	if err = os.WriteFile(filename, append(content, '\n'), 0664); err != nil {
+		return fmt.Errorf("write report %s failed: %w", filename, err)
+	}
+	return nil
+}
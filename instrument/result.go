@@ -0,0 +1,66 @@
+package instrument
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jattle/go-instrumentation/instrument/rewriter"
+)
+
+// FileResult instrumentation result of source file
+type FileResult struct {
+	// Filename source file
+	Filename string
+	// Output file instrumentation result is saved to, empty if result is not saved
+	Output string
+	// Changed whether content is changed by instrumentation
+	Changed bool
+	// Funcs instrumented functions
+	Funcs []rewriter.FuncResult
+	// Skipped functions not instrumented with reasons
+	Skipped []rewriter.FuncResult
+	// Original content of source file
+	Original []byte
+	// Content instrumentation result
+	Content []byte
+	// Warnings problems not stopping instrumentation, eg: type errors of source package
+	Warnings []string
+	// Err error of instrumenting source file
+	Err error
+}
+
+// Result instrumentation results of source files
+type Result struct {
+	Files []FileResult
+}
+
+// ChangedFiles source files changed by instrumentation
+func (r Result) ChangedFiles() []string {
+	var files []string
+	for _, f := range r.Files {
+		if f.Changed && f.Err == nil {
+			files = append(files, f.Filename)
+		}
+	}
+	return files
+}
+
+// Failed results of source files failed to instrument
+func (r Result) Failed() []FileResult {
+	var failed []FileResult
+	for _, f := range r.Files {
+		if f.Err != nil {
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// Err errors of all failed source files joined, nil if no file failed
+func (r Result) Err() error {
+	var errs []error
+	for _, f := range r.Failed() {
+		errs = append(errs, fmt.Errorf("instrument source %s failed: %w", f.Filename, f.Err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,123 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/internal/instrument/astvisitor"
+)
+
+const (
+	funcDescTypePrefix = "instrumentFuncDesc"
+	funcDescVarPrefix  = "instrumentFunc"
+	// funcDescParamIndex index of descriptor param of entry and exit patch funcs, it is declared before args
+	funcDescParamIndex = 3
+)
+
+// funcDesc static descriptor of source function, it is generated as package level var of filter.FuncDescType,
+// so patches get names and types of args without reflection
+type funcDesc struct {
+	varName    string
+	fn         string
+	file       string
+	line       int
+	paramNames []string
+	paramTypes []string
+}
+
+// newFuncDesc descriptor of source function, var is named by hash of file, function name and line,
+// so it is unique in package and stable between instrumentations
+func newFuncDesc(filename, funcName string, line int, funcType *ast.FuncType) funcDesc {
+	desc := funcDesc{
+		varName: funcDescVarPrefix + astvisitor.GenHashVarSuffix(path.Base(filename),
+			fmt.Sprintf("%s:%d", funcName, line), 0),
+		fn:   funcName,
+		file: path.Base(filename),
+		line: line,
+	}
+	desc.paramNames, desc.paramTypes = sourceArgs(funcType)
+	return desc
+}
+
+// sourceArgs names and types of source function params passed to patches as args, blank and unnamed params are
+// skipped, types are formatted as in source code
+func sourceArgs(funcType *ast.FuncType) (names, typeNames []string) {
+	for _, field := range funcType.Params.List {
+		for _, name := range field.Names {
+			if isBlankIdent(name.Name) {
+				continue
+			}
+			names = append(names, name.Name)
+			typeNames = append(typeNames, types.ExprString(field.Type))
+		}
+	}
+	return names, typeNames
+}
+
+// patchFuncDesc name of descriptor param of patch func, empty if it is not declared or ignored
+func patchFuncDesc(patchFunc *ast.FuncDecl) string {
+	params := patchFunc.Type.Params.List
+	if len(params) <= funcDescParamIndex+1 || !filter.IsFuncDescType(params[funcDescParamIndex].Type) {
+		return ""
+	}
+	return patchParamName(patchFunc, funcDescParamIndex)
+}
+
+// hasFuncDesc any patch func reads descriptor of source function
+func hasFuncDesc(patchFuncs []*ast.FuncDecl) bool {
+	for _, patchFunc := range patchFuncs {
+		if patchFuncDesc(patchFunc) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// funcDescsEdit append descriptors of source functions to the end of source file, type of descriptors is aliased
+// once per file
+//
+//	type instrumentFuncDescSuffix = struct {...}
+//
+//	var (
+//		instrumentFuncSuffix = &instrumentFuncDescSuffix{Func: "Foo", File: "foo.go", Line: 3, ...}
+//	)
+func funcDescsEdit(source parser.FileMeta, descs []funcDesc) (Edit, error) {
+	typeName := funcDescTypePrefix + astvisitor.GenHashVarSuffix(path.Base(source.FileName), "", 0)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "type %s = %s\n\nvar (\n", typeName, strings.TrimPrefix(filter.FuncDescType, "*"))
+	for _, desc := range descs {
+		fmt.Fprintf(&buf, "\t%s = &%s{Func: %s, File: %s, Line: %d", desc.varName, typeName, strconv.Quote(desc.fn),
+			strconv.Quote(desc.file), desc.line)
+		if len(desc.paramNames) > 0 {
+			fmt.Fprintf(&buf, ", ParamNames: %s, ParamTypes: %s", stringSliceLit(desc.paramNames),
+				stringSliceLit(desc.paramTypes))
+		}
+		buf.WriteString("}\n")
+	}
+	buf.WriteString(")\n")
+	content, err := format.Source(buf.Bytes())
+	if err != nil {
+		return Edit{}, fmt.Errorf("format func descriptors failed: %w", err)
+	}
+	pos := len(source.Content)
+	// gofmt separates end marker from decls by a blank line
+	content = append(content, '\n')
+	return Edit{OpType: EditTypeAdd, BeginPos: pos, EndPos: pos, Content: markBlock(descMarkerName, 0, content)}, nil
+}
+
+// stringSliceLit []string{"a", "b"}
+func stringSliceLit(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, strconv.Quote(v))
+	}
+	return "[]string{" + strings.Join(quoted, ", ") + "}"
+}
@@ -0,0 +1,156 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+const (
+	markerBeginPrefix = "//instrument:begin "
+	markerEndPrefix   = "//instrument:end "
+	// importMarkerName marker name of injected imports, import is a keyword, so it never conflicts with patch names
+	importMarkerName = "import"
+	// descMarkerName marker name of injected func descriptors, func is a keyword too
+	descMarkerName = "func"
+	// lineDirectivePrefix line directive following end marker, it restores positions of source code after block
+	lineDirectivePrefix = "//line "
+)
+
+// markedBlock code block injected by rewriter, delimited by begin and end marker comments
+//
+//	//instrument:begin PatchName
+//	injected code...
+//	//instrument:end PatchName
+//
+// block range is [Begin, End) of byte offsets, including the newline and indentation before begin marker,
+// and the newline after end marker, which are exactly the bytes inserted by rewriter.
+type markedBlock struct {
+	Name       string
+	Begin, End int
+}
+
+// markBlock wrap injected code with markers, body is lines of code each ending with newline
+func markBlock(name string, indent int, body []byte) []byte {
+	tabs := strings.Repeat("\t", indent)
+	var buf bytes.Buffer
+	buf.WriteString("\n" + tabs + markerBeginPrefix + name + "\n")
+	buf.Write(body)
+	buf.WriteString(tabs + markerEndPrefix + name + "\n")
+	return buf.Bytes()
+}
+
+// findMarkedBlocks find all marked blocks of source file, sorted by offset
+func findMarkedBlocks(meta parser.FileMeta) ([]markedBlock, error) {
+	var (
+		blocks []markedBlock
+		open   *markedBlock
+	)
+	for _, group := range meta.ASTFile.Comments {
+		for _, comment := range group.List {
+			offset := meta.FSet.Position(comment.Pos()).Offset
+			switch {
+			case strings.HasPrefix(comment.Text, markerBeginPrefix):
+				if open != nil {
+					return nil, fmt.Errorf("%s: nested marker %s in block %s",
+						meta.FSet.Position(comment.Pos()), comment.Text, open.Name)
+				}
+				open = &markedBlock{
+					Name:  strings.TrimSpace(strings.TrimPrefix(comment.Text, markerBeginPrefix)),
+					Begin: blockBegin(meta.Content, offset),
+				}
+			case strings.HasPrefix(comment.Text, markerEndPrefix):
+				name := strings.TrimSpace(strings.TrimPrefix(comment.Text, markerEndPrefix))
+				if open == nil || open.Name != name {
+					return nil, fmt.Errorf("%s: unmatched marker %s", meta.FSet.Position(comment.Pos()), comment.Text)
+				}
+				open.End = blockEnd(meta.Content, offset+len(comment.Text))
+				blocks = append(blocks, *open)
+				open = nil
+			}
+		}
+	}
+	if open != nil {
+		return nil, fmt.Errorf("%s: marker block %s not closed", meta.FileName, open.Name)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Begin < blocks[j].Begin })
+	return blocks, nil
+}
+
+// blockBegin include indentation and newline before begin marker
+func blockBegin(content []byte, offset int) int {
+	for offset > 0 && (content[offset-1] == ' ' || content[offset-1] == '\t') {
+		offset--
+	}
+	if offset > 0 && content[offset-1] == '\n' {
+		offset--
+	}
+	return offset
+}
+
+// blockEnd include newline after end marker, and line directive following it
+func blockEnd(content []byte, offset int) int {
+	if offset < len(content) && content[offset] == '\n' {
+		offset++
+	}
+	if bytes.HasPrefix(content[offset:], []byte(lineDirectivePrefix)) {
+		if i := bytes.IndexByte(content[offset:], '\n'); i >= 0 {
+			offset += i + 1
+		}
+	}
+	return offset
+}
+
+// lineDirective line directive placed after block injected at pos, so source code following block keeps its
+// original position in compiler errors, panics and profiles. shift is bytes added before pos on the same line by
+// previous instrumentation(negative), so column is the one of original source when instrumenting again. relative filename of directive is resolved against dir of
+// the file by compiler, so base name is used unless source filename is absolute.
+func lineDirective(srcMeta parser.FileMeta, pos token.Pos, shift int) []byte {
+	position := srcMeta.FSet.Position(pos)
+	filename := srcMeta.FileName
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Base(filename)
+	}
+	return []byte(fmt.Sprintf("%s%s:%d:%d\n", lineDirectivePrefix, filename, position.Line, position.Column+shift))
+}
+
+// columnShift bytes added(or removed if negative) by edits before pos on the same line
+func columnShift(srcMeta parser.FileMeta, edits []Edit, pos token.Pos) int {
+	offset := srcMeta.FSet.Position(pos).Offset
+	var shift int
+	for _, e := range edits {
+		if e.BeginPos > offset || bytes.IndexByte(srcMeta.Content[e.BeginPos:offset], '\n') >= 0 {
+			continue
+		}
+		switch e.OpType {
+		case EditTypeAdd:
+			shift += len(e.Content)
+		case EditTypeReplace:
+			shift += len(e.Content) - (e.EndPos - e.BeginPos + 1)
+		case EditTypeDel:
+			shift -= e.EndPos - e.BeginPos + 1
+		}
+	}
+	return shift
+}
+
+// delBlockEdit edit deleting marked block
+func delBlockEdit(block markedBlock) Edit {
+	// end pos of del edit is inclusive
+	return Edit{OpType: EditTypeDel, BeginPos: block.Begin, EndPos: block.End - 1}
+}
+
+// inBlocks whether offset is in any of blocks
+func inBlocks(blocks []markedBlock, offset int) bool {
+	for _, b := range blocks {
+		if offset >= b.Begin && offset < b.End {
+			return true
+		}
+	}
+	return false
+}
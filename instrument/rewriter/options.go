@@ -0,0 +1,53 @@
+package rewriter
+
+import (
+	"fmt"
+	"text/template"
+
+	"github.com/jattle/go-instrumentation/instrument/config"
+	"github.com/jattle/go-instrumentation/instrument/filter"
+)
+
+// Options options of rewriting source files, options are only read during rewriting, so source files can be
+// rewritten concurrently with the same or different options.
+type Options struct {
+	// PatchSet patches applied to source functions, required
+	PatchSet *PatchSet
+	// Filter select source function declarations to instrument, filter.DefaultFuncFilter() is used if nil
+	Filter filter.FuncFilter
+	// FuncRules rules selecting functions to instrument and patches applied to them, function literals are matched
+	// by their enclosing functions, all functions are selected if nil
+	FuncRules *config.Config
+	// FuncLit instrument function literals too, eg: goroutine bodies, handler closures,
+	// and package level `var f = func() {}`
+	FuncLit bool
+	// TypeParams include type params in names of generic functions and methods of generic types,
+	// eg: Keys[K,V], (*Map[K,V]).Get, so span names of them are distinguished from other functions
+	TypeParams bool
+	// SpanNameTemplate template of span names passed to patch funcs, executed with SpanNameData,
+	// eg: parsed by ParseSpanNameTemplate, span names are like source.go-main.(*T).Foo if nil
+	SpanNameTemplate *template.Template
+	// CtxAccessors accessors of params which carry context.Context, DefaultCtxAccessors() is used if nil
+	CtxAccessors map[string]CtxAccessor
+	// Verify parse rewritten source, and type check it by TypeChecker if provided, *VerifyError is returned
+	// if it fails to compile
+	Verify bool
+	// TypeChecker type check package of rewritten source in verification, only syntax is verified if nil
+	TypeChecker TypeChecker
+	// Rollback keep source content if verification fails, instead of returning error, instrumented functions
+	// are reported as skipped and the error is recorded in FileResult.VerifyErr
+	Rollback bool
+}
+
+func (o Options) withDefaults() (Options, error) {
+	if o.PatchSet == nil {
+		return o, fmt.Errorf("patch set not provided")
+	}
+	if o.Filter == nil {
+		o.Filter = filter.DefaultFuncFilter()
+	}
+	if o.CtxAccessors == nil {
+		o.CtxAccessors = DefaultCtxAccessors()
+	}
+	return o, nil
+}
@@ -0,0 +1,312 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/internal/instrument/astvisitor"
+)
+
+// maxNamingSalt max attempts to rename patch vars when names conflict
+const maxNamingSalt = 32
+
+// PatchSet patch files and their rewritten patch funcs, patch asts are rewritten only once,
+// so one patch set can be applied to many source files.
+type PatchSet struct {
+	Patches []parser.FileMeta
+	Funcs   []*ast.FuncDecl
+	// Invalid patch files ignored since no patch func found in them
+	Invalid []InvalidPatch
+
+	naming NamingStrategy
+	// infos of Funcs and their renamed copies
+	infos map[*ast.FuncDecl]*patchFuncInfo
+	mu    sync.Mutex
+}
+
+// InvalidPatch patch file ignored by patch set
+type InvalidPatch struct {
+	FileName string
+	Err      error
+}
+
+// patchFuncInfo patch function renamed by salt
+type patchFuncInfo struct {
+	patch int // index of Patches
+	salt  int
+	vars  map[string]struct{} // renamed var names
+	// copies renamed by other salts, only set for funcs in Funcs
+	salted map[int]*ast.FuncDecl
+	// comments in body of patch func, they are injected with patch body
+	comments funcComments
+}
+
+// funcComments comments in body of patch func, positions are of file set patch func is parsed by
+type funcComments struct {
+	fset *token.FileSet
+	list []*ast.CommentGroup
+}
+
+// bodyComments comments associated with nodes of patch func body by comment map
+func bodyComments(patch parser.FileMeta, decl *ast.FuncDecl) funcComments {
+	cmap := ast.NewCommentMap(patch.FSet, decl, patch.ASTFile.Comments)
+	return funcComments{fset: patch.FSet, list: cmap.Filter(decl.Body).Comments()}
+}
+
+// NewPatchSet rewrite patch file asts and collect patch funcs, invalid patch file is ignored and recorded in Invalid
+func NewPatchSet(patches []parser.FileMeta) (*PatchSet, error) {
+	return NewPatchSetWithNaming(patches, NamingHash)
+}
+
+// NewPatchSetWithNaming same as NewPatchSet, but vars of patch funcs are renamed by naming strategy
+func NewPatchSetWithNaming(patches []parser.FileMeta, naming NamingStrategy) (*PatchSet, error) {
+	patchSet := &PatchSet{
+		Patches: patches,
+		Funcs:   make([]*ast.FuncDecl, 0, len(patches)),
+		naming:  naming,
+		infos:   make(map[*ast.FuncDecl]*patchFuncInfo),
+	}
+	for i := range patches {
+		funcDecls, err := rewritePatchAST(patches[i], naming)
+		if err != nil {
+			patchSet.Invalid = append(patchSet.Invalid, InvalidPatch{FileName: patches[i].FileName, Err: err})
+			continue
+		}
+		for _, decl := range funcDecls {
+			vars := patchFuncVars(decl)
+			patchSet.infos[decl] = &patchFuncInfo{patch: i, vars: vars, salted: make(map[int]*ast.FuncDecl),
+				comments: bodyComments(patches[i], decl)}
+		}
+		patchSet.Funcs = append(patchSet.Funcs, funcDecls...)
+	}
+	if len(patchSet.Funcs) == 0 {
+		return nil, fmt.Errorf("no valid patch func found")
+	}
+	// entry patches go first, so exit patches are deferred after defers of entry patches and executed before them
+	sort.SliceStable(patchSet.Funcs, func(i, j int) bool {
+		return filter.GetPatchKind(patchSet.Funcs[i]) < filter.GetPatchKind(patchSet.Funcs[j])
+	})
+	return patchSet, nil
+}
+
+// FuncNames names of patch funcs declared in Patches[patch]
+func (p *PatchSet) FuncNames(patch int) []string {
+	var names []string
+	for _, f := range p.Funcs {
+		if p.patchIndex(f) == patch {
+			names = append(names, f.Name.Name)
+		}
+	}
+	return names
+}
+
+// funcsOf patch funcs of patch files, all patch funcs returned if files is nil
+func (p *PatchSet) funcsOf(files []string) []*ast.FuncDecl {
+	if files == nil {
+		return p.Funcs
+	}
+	selected := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		selected[filepath.Clean(file)] = struct{}{}
+	}
+	funcs := make([]*ast.FuncDecl, 0, len(p.Funcs))
+	for _, f := range p.Funcs {
+		if index := p.patchIndex(f); index >= 0 {
+			if _, ok := selected[filepath.Clean(p.Patches[index].FileName)]; ok {
+				funcs = append(funcs, f)
+			}
+		}
+	}
+	return funcs
+}
+
+// funcsNamed patch funcs with given names, all funcs returned if names is nil, error returned if any name is not
+// declared by patch set
+func (p *PatchSet) funcsNamed(funcs []*ast.FuncDecl, names []string) ([]*ast.FuncDecl, error) {
+	if names == nil {
+		return funcs, nil
+	}
+	selected := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if !p.declares(name) {
+			return nil, fmt.Errorf("patch func %s not found", name)
+		}
+		selected[name] = struct{}{}
+	}
+	named := make([]*ast.FuncDecl, 0, len(funcs))
+	for _, f := range funcs {
+		if _, ok := selected[f.Name.Name]; ok {
+			named = append(named, f)
+		}
+	}
+	return named, nil
+}
+
+func (p *PatchSet) declares(name string) bool {
+	for _, f := range p.Funcs {
+		if f.Name.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKind(funcs []*ast.FuncDecl, kind filter.PatchKind) bool {
+	for _, f := range funcs {
+		if filter.GetPatchKind(f) == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// extraImportSpecs import specs needed by generated code
+func (p *PatchSet) extraImportSpecs() []*ast.ImportSpec {
+	const stackParamIndex = 3
+	for _, f := range p.Funcs {
+		if filter.GetPatchKind(f) == filter.PatchKindPanic && patchParamName(f, stackParamIndex) != "" {
+			return []*ast.ImportSpec{newImportSpec(nativeDebugPkgName, nativeDebugPkgPath)}
+		}
+	}
+	return nil
+}
+
+// importSpecs import specs of patch file, and import specs needed by generated code
+func (p *PatchSet) importSpecs(patchIndex int) []*ast.ImportSpec {
+	specs := make([]*ast.ImportSpec, 0)
+	traverseDeclSpecs(getImportDecls(p.Patches[patchIndex], nil), func(spec ast.Spec) {
+		specs = append(specs, spec.(*ast.ImportSpec))
+	})
+	return append(specs, p.extraImportSpecs()...)
+}
+
+// importNames names of packages imported by patch file and generated code, empty if patch index is invalid
+func (p *PatchSet) importNames(patchIndex int) map[string]struct{} {
+	names := make(map[string]struct{})
+	if patchIndex < 0 || patchIndex >= len(p.Patches) {
+		return names
+	}
+	for _, spec := range p.importSpecs(patchIndex) {
+		names[importName(p.Patches[patchIndex], spec)] = struct{}{}
+	}
+	return names
+}
+
+// resolveNameConflicts get copy of patch func whose renamed vars do not conflict with taken names,
+// vars of returned func are added into taken names.
+func (p *PatchSet) resolveNameConflicts(decl *ast.FuncDecl, taken map[string]struct{}) (*ast.FuncDecl, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.infos[decl]
+	if !ok {
+		// not created by NewPatchSet, use it as is
+		return decl, nil
+	}
+	for salt := 0; salt < maxNamingSalt; salt++ {
+		salted, err := p.saltedFunc(decl, info, salt)
+		if err != nil {
+			return nil, err
+		}
+		vars := p.infos[salted].vars
+		if !conflicts(vars, taken) {
+			for v := range vars {
+				taken[v] = struct{}{}
+			}
+			return salted, nil
+		}
+	}
+	return nil, fmt.Errorf("vars of patch %s conflict with source identifiers", decl.Name.Name)
+}
+
+// saltedFunc copy of patch func renamed by salt, copy is created by parsing patch file again
+func (p *PatchSet) saltedFunc(decl *ast.FuncDecl, info *patchFuncInfo, salt int) (*ast.FuncDecl, error) {
+	if salt == info.salt {
+		return decl, nil
+	}
+	if salted, ok := info.salted[salt]; ok {
+		return salted, nil
+	}
+	salted, comments, err := p.parseFunc(info.patch, decl.Name.Name, salt)
+	if err != nil {
+		return nil, err
+	}
+	p.infos[salted] = &patchFuncInfo{patch: info.patch, salt: salt, vars: patchFuncVars(salted), comments: comments}
+	info.salted[salt] = salted
+	return salted, nil
+}
+
+// copyFunc get a new copy of patch func and its comments which can be modified for one source file, patch func
+// returned by resolveNameConflicts is shared by all source files
+func (p *PatchSet) copyFunc(decl *ast.FuncDecl) (*ast.FuncDecl, funcComments, error) {
+	p.mu.Lock()
+	info, ok := p.infos[decl]
+	p.mu.Unlock()
+	if !ok {
+		return nil, funcComments{}, fmt.Errorf("patch func %s not found in patch set", decl.Name.Name)
+	}
+	return p.parseFunc(info.patch, decl.Name.Name, info.salt)
+}
+
+// commentsOf comments in body of patch func, empty if patch func is not in patch set
+func (p *PatchSet) commentsOf(decl *ast.FuncDecl) funcComments {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info, ok := p.infos[decl]; ok {
+		return info.comments
+	}
+	return funcComments{}
+}
+
+// patchIndex index of patch file which patch func belongs to, -1 if patch func is not in patch set
+func (p *PatchSet) patchIndex(decl *ast.FuncDecl) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if info, ok := p.infos[decl]; ok {
+		return info.patch
+	}
+	return -1
+}
+
+// parseFunc parse patch file again to get a new copy of patch func, and rename its vars by salt
+func (p *PatchSet) parseFunc(patchIndex int, name string, salt int) (*ast.FuncDecl, funcComments, error) {
+	patch := p.Patches[patchIndex]
+	meta, err := parser.ParseContent(patch.FileName, patch.Content)
+	if err != nil {
+		return nil, funcComments{}, err
+	}
+	funcs := filter.SelectFuncDecls(meta.ASTFile.Decls, func(f *ast.FuncDecl) bool {
+		return f.Name.Name == name
+	})
+	if len(funcs) != 1 {
+		return nil, funcComments{}, fmt.Errorf("patch func %s not found in %s", name, patch.FileName)
+	}
+	if err = rewritePatchFunc(meta, funcs[0], salt, p.naming); err != nil {
+		return nil, funcComments{}, err
+	}
+	return funcs[0], bodyComments(meta, funcs[0]), nil
+}
+
+// patchFuncVars renamed vars and labels of patch func, blank identifier never conflicts
+func patchFuncVars(decl *ast.FuncDecl) map[string]struct{} {
+	vars, _ := astvisitor.CollectFuncVars(decl)
+	for label := range astvisitor.CollectFuncLabels(decl) {
+		vars[label] = struct{}{}
+	}
+	delete(vars, "_")
+	return vars
+}
+
+func conflicts(vars, taken map[string]struct{}) bool {
+	for v := range vars {
+		if _, ok := taken[v]; ok {
+			return true
+		}
+	}
+	return false
+}
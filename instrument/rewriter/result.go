@@ -0,0 +1,38 @@
+package rewriter
+
+import "go/token"
+
+// reasons why source functions are not instrumented
+const (
+	SkipReasonExcludeComment  = "excluded by //instrument:exclude comment"
+	SkipReasonFiltered        = "excluded by name pattern or filter"
+	SkipReasonNoRule          = "not matched by rules"
+	SkipReasonUnsupportedRecv = "unsupported receiver type"
+	SkipReasonNoPatch         = "no patch selected"
+	SkipReasonNoFuncBody      = "no function body"
+	SkipReasonRolledBack      = "rolled back since instrumented source fails to compile"
+)
+
+// FuncResult instrumentation result of source function
+type FuncResult struct {
+	// Name qualified function name, eg: (*T).Foo, Foo.func1
+	Name string
+	// SpanName span name passed to patch funcs, empty if function is skipped
+	SpanName string
+	// Pos position of function in source file
+	Pos token.Position
+	// Patches names of patch funcs injected into function
+	Patches []string
+	// SkipReason why function is not instrumented, empty if function is instrumented
+	SkipReason string
+}
+
+// FileResult instrumentation result of source file
+type FileResult struct {
+	// Funcs instrumented functions
+	Funcs []FuncResult
+	// Skipped functions not instrumented
+	Skipped []FuncResult
+	// VerifyErr verification error of rolled back instrumentation, see Options.Rollback
+	VerifyErr *VerifyError
+}
@@ -1,19 +1,152 @@
 package rewriter
 
 import (
+	"bytes"
 	"go/ast"
 	"go/token"
+	"strconv"
 
+	"github.com/jattle/go-instrumentation/instrument/filter"
 	"github.com/jattle/go-instrumentation/instrument/parser"
 	"github.com/jattle/go-instrumentation/instrument/printer"
 )
 
-func rewriteSourceFunc(spanName string, srcMeta parser.FileMeta,
-	sourceFunc, patchFunc *ast.FuncDecl) (edits []Edit, err error) {
-	if sourceFunc.Body == nil {
+const (
+	// nativeDebugPkgName alias of runtime/debug imported by generated code of panic patches
+	nativeDebugPkgName = "gonativedebug"
+	nativeDebugPkgPath = "runtime/debug"
+	// recoveredVarName recovered panic value if it is ignored by panic patch
+	recoveredVarName = "instrumentRecovered"
+	// patchBodyPlaceholder stands for patch body in generated code when patch body is printed with comments
+	patchBodyPlaceholder = "instrumentPatchBody"
+)
+
+// sourceFuncMeta source function to instrument, and its information used by generated code of patches
+type sourceFuncMeta struct {
+	spanName string
+	// desc var name of func descriptor, empty if no patch reads it
+	desc     string
+	funcType *ast.FuncType
+	body     *ast.BlockStmt
+	ctx      sourceCtx
+	results  []resultVar
+	// columnShift bytes added before body of source function on the same line by previous instrumentation,
+	// negative or zero, eg: names of results, so line directive keeps column of original source
+	columnShift int
+}
+
+// genPatchStmts generate stmts injected into source function for patch func, nil returned if source function
+// has no body, stmts share nodes with patch func, so they should not be modified.
+func genPatchStmts(source sourceFuncMeta, patchFunc *ast.FuncDecl) []ast.Stmt {
+	if source.body == nil {
+		return nil
+	}
+	switch filter.GetPatchKind(patchFunc) {
+	case filter.PatchKindEntry:
+		return genEntryStmts(source, patchFunc)
+	case filter.PatchKindExit:
+		return genExitStmts(source, patchFunc)
+	case filter.PatchKindPanic:
+		return genPanicStmts(source, patchFunc)
+	}
+	return nil
+}
+
+// rewriteSourceFunc inject stmts generated for patch func into source function, comments in patch body are kept,
+// and a line directive after injected code restores positions of source function
+func rewriteSourceFunc(srcMeta parser.FileMeta, source sourceFuncMeta, patchFunc *ast.FuncDecl,
+	blocks []ast.Stmt, comments funcComments) (edits []Edit, err error) {
+	if len(blocks) == 0 {
 		return
 	}
-	// insert init part of this patch function into begin of source function body
+	// generated code has no positions, so comments can only be printed with patch body, which is printed
+	// separately and replaces the placeholder
+	withComments := len(comments.list) > 0 && len(patchFunc.Body.List) > 0
+	if withComments {
+		blocks = replacePatchBody(blocks, patchFunc.Body.List, &ast.ExprStmt{X: ast.NewIdent(patchBodyPlaceholder)})
+	}
+	var astBytes []byte
+	// function block stmts, indented by 1 tab
+	astBytes, err = printer.PrintAstNode(blocks, 1)
+	if err != nil {
+		return
+	}
+	if withComments {
+		if astBytes, err = splicePatchBody(astBytes, patchFunc.Body, comments); err != nil {
+			return
+		}
+	}
+	// token pos is comapacted, get exact bytes offset here
+	pos := srcMeta.FSet.Position(source.body.Lbrace).Offset + 1
+	edit := Edit{
+		OpType:   EditTypeAdd,
+		BeginPos: pos,
+		EndPos:   pos,
+		// wrap injected code with markers, ignore leading char '\n'
+		Content: append(markBlock(patchFunc.Name.Name, 1, astBytes[1:]), lineDirective(srcMeta, source.body.Lbrace+1,
+			source.columnShift)...),
+	}
+	edits = append(edits, edit)
+	return
+}
+
+// replacePatchBody replace stmts of patch body in generated stmts with placeholder, blocks generated around
+// patch body are modified, nodes of patch body are untouched since they are shared
+func replacePatchBody(stmts, body []ast.Stmt, placeholder ast.Stmt) []ast.Stmt {
+	if replaced, ok := replaceStmts(stmts, body, placeholder); ok {
+		return replaced
+	}
+	for _, stmt := range stmts {
+		var found bool
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			block, ok := n.(*ast.BlockStmt)
+			if found || !ok {
+				return !found
+			}
+			block.List, found = replaceStmts(block.List, body, placeholder)
+			return !found
+		})
+		if found {
+			break
+		}
+	}
+	return stmts
+}
+
+// replaceStmts new list with sub list sub replaced by stmt, list is returned as is if sub is not found
+func replaceStmts(list, sub []ast.Stmt, stmt ast.Stmt) ([]ast.Stmt, bool) {
+	for i := 0; i+len(sub) <= len(list); i++ {
+		if list[i] == sub[0] && list[i+len(sub)-1] == sub[len(sub)-1] {
+			replaced := make([]ast.Stmt, 0, len(list)-len(sub)+1)
+			replaced = append(append(append(replaced, list[:i]...), stmt), list[i+len(sub):]...)
+			return replaced, true
+		}
+	}
+	return list, false
+}
+
+// splicePatchBody replace placeholder line of printed code with patch body printed with comments
+func splicePatchBody(code []byte, body *ast.BlockStmt, comments funcComments) ([]byte, error) {
+	index := bytes.Index(code, []byte(patchBodyPlaceholder))
+	if index < 0 {
+		return code, nil
+	}
+	lineBegin := bytes.LastIndexByte(code[:index], '\n') + 1
+	lineEnd := index + len(patchBodyPlaceholder)
+	if lineEnd < len(code) && code[lineEnd] == '\n' {
+		lineEnd++
+	}
+	bodyCode, err := printer.PrintBlockStmts(comments.fset, body, comments.list, index-lineBegin)
+	if err != nil {
+		return nil, err
+	}
+	spliced := make([]byte, 0, len(code)+len(bodyCode))
+	spliced = append(append(append(spliced, code[:lineBegin]...), bodyCode...), code[lineEnd:]...)
+	return spliced, nil
+}
+
+// genEntryStmts insert init part of this patch function into begin of source function body
+func genEntryStmts(source sourceFuncMeta, patchFunc *ast.FuncDecl) []ast.Stmt {
 	// patch function:
 	// 	ProcessFunc(spanName string, hasCtx bool, ctx context.Context, args ...interface{})
 	// auto generated code snippet for it:
@@ -21,58 +154,147 @@ func rewriteSourceFunc(spanName string, srcMeta parser.FileMeta,
 	// 	if has ctx param:
 	// 		   hasCtxSuffix := true
 	// 	else hasCtxSuffix = false
+	// 	fnSuffix := instrumentFuncDesc if patch declares descriptor param
 	// 	argsSuffix := []interface{}{ctx, args...}
+	// 	or argsSuffix := func() []interface{} { return []interface{}{ctx, args...} } for lazy args
+	const (
+		hasCtxParamIndex = 1
+		ctxParamIndex    = 2
+	)
+	// args is the last param, descriptor param may be declared before it
+	argsParamIndex := len(patchFunc.Type.Params.List) - 1
 	initStmts := make([]ast.Stmt, 0, 4)
 	// always add span stmt
-	initStmts = append(initStmts, createSpanStmt(spanName, patchFunc))
+	initStmts = append(initStmts, createSpanStmt(source.spanName, patchFunc))
 	// add hasCtxSuffix := boolean if patchFunc do not ignore this param
-	if stmt := createHasCtxDefStmt(sourceFunc, patchFunc); stmt != nil {
+	if stmt := createHasCtxDefStmt(source.ctx, patchParamName(patchFunc, hasCtxParamIndex)); stmt != nil {
 		initStmts = append(initStmts, stmt)
 	}
 	// add ctxSuffix := ctx if patchFunc do not ignore this param
-	if stmt := createPatchCtxDefStmt(sourceFunc, patchFunc); stmt != nil {
+	initStmts = append(initStmts, createPatchCtxDefStmts(source.ctx, patchParamName(patchFunc, ctxParamIndex))...)
+	if stmt := createFuncDescDefStmt(source.desc, patchFuncDesc(patchFunc)); stmt != nil {
 		initStmts = append(initStmts, stmt)
 	}
 	// add  argsSuffix := []interface{}{ctx, args...} if patchFunc do not ignore param args
-	if stmt := createArgsDefStmt(sourceFunc, patchFunc); stmt != nil {
+	if stmt := createArgsDefStmt(source.funcType, patchParamName(patchFunc, argsParamIndex),
+		patchParamLazy(patchFunc, argsParamIndex)); stmt != nil {
 		initStmts = append(initStmts, stmt)
 	}
 	blocks := make([]ast.Stmt, 0, len(initStmts)+len(patchFunc.Body.List))
 	blocks = append(append(blocks, initStmts...), patchFunc.Body.List...)
 	// add ctx = ctxSuffix if source ctx exists and is not ignored by patchFunc, so ctx values can propagate
-	if sourceCtxStmt := createSourceCtxAssignStmt(sourceFunc, patchFunc); sourceCtxStmt != nil {
+	if sourceCtxStmt := createSourceCtxAssignStmt(source.ctx, patchParamName(patchFunc, ctxParamIndex)); sourceCtxStmt != nil {
 		blocks = append(blocks, sourceCtxStmt)
 	}
-	var astBytes []byte
-	// function block stmts, indented by 1 tab
-	// NOTE: comments in patchFunc would be dropped when printing ast node
-	astBytes, err = printer.PrintAstNode(blocks, 1)
-	if err != nil {
-		return
+	return blocks
+}
+
+// genExitStmts defer patch function body, so it can see final results of source function
+func genExitStmts(source sourceFuncMeta, patchFunc *ast.FuncDecl) []ast.Stmt {
+	// patch function:
+	// 	ExitFunc(spanName string, ctx context.Context, err error, results ...interface{})
+	// auto generated code snippet for it:
+	// 	defer func() {
+	// 		spanNameSuffix := spanName
+	// 		ctxSuffix := ctx
+	// 		var errSuffix error = lastErrorResult
+	// 		fnSuffix := instrumentFuncDesc if patch declares descriptor param
+	// 		resultsSuffix := []interface{}{result0, result1...}, or func() []interface{} for lazy results
+	// 		patch body...
+	// 	}()
+	const (
+		ctxParamIndex = 1
+		errParamIndex = 2
+	)
+	// results is the last param, descriptor param may be declared before it
+	resultsParamIndex := len(patchFunc.Type.Params.List) - 1
+	stmts := make([]ast.Stmt, 0, 4+len(patchFunc.Body.List))
+	stmts = append(stmts, createSpanStmt(source.spanName, patchFunc))
+	stmts = append(stmts, createPatchCtxDefStmts(source.ctx, patchParamName(patchFunc, ctxParamIndex))...)
+	if stmt := createErrDefStmt(source.results, patchParamName(patchFunc, errParamIndex)); stmt != nil {
+		stmts = append(stmts, stmt)
 	}
-	// token pos is comapacted, get exact bytes offset here
-	pos := srcMeta.FSet.Position(sourceFunc.Body.Lbrace).Offset + 1
-	edit := Edit{
-		OpType:   EditTypeAdd,
-		BeginPos: pos,
-		EndPos:   pos,
-		Content:  astBytes,
+	if stmt := createFuncDescDefStmt(source.desc, patchFuncDesc(patchFunc)); stmt != nil {
+		stmts = append(stmts, stmt)
 	}
-	edits = append(edits, edit)
-	return
+	resultNames := make([]string, 0, len(source.results))
+	for _, r := range source.results {
+		resultNames = append(resultNames, r.name)
+	}
+	if stmt := createInterfaceSliceDefStmt(resultNames, patchParamName(patchFunc, resultsParamIndex),
+		patchParamLazy(patchFunc, resultsParamIndex)); stmt != nil {
+		stmts = append(stmts, stmt)
+	}
+	stmts = append(stmts, patchFunc.Body.List...)
+	return []ast.Stmt{createDeferFuncLitStmt(stmts)}
 }
 
-func getCtxParamName(decl *ast.FuncDecl) string {
-	for _, field := range decl.Type.Params.List {
-		sel, ok := field.Type.(*ast.SelectorExpr)
-		if ok && sel.X.(*ast.Ident).Name == "context" && sel.Sel.Name == "Context" {
-			// func abc(context.Context,string) is valid
-			if len(field.Names) > 0 {
-				return field.Names[0].Name
-			}
-		}
+// genPanicStmts defer recover-and-repanic wrapper of patch function body, patch body is executed only if
+// source function panics, and panic is re-raised after patch body, so panic is never swallowed
+func genPanicStmts(source sourceFuncMeta, patchFunc *ast.FuncDecl) []ast.Stmt {
+	// patch function:
+	// 	PanicFunc(spanName string, ctx context.Context, recovered interface{}, stack []byte)
+	// auto generated code snippet for it:
+	// 	defer func() {
+	// 		if recoveredSuffix := recover(); recoveredSuffix != nil {
+	// 			spanNameSuffix := spanName
+	// 			ctxSuffix := ctx
+	// 			stackSuffix := gonativedebug.Stack()
+	// 			patch body...
+	// 			panic(recoveredSuffix)
+	// 		}
+	// 	}()
+	const (
+		ctxParamIndex       = 1
+		recoveredParamIndex = 2
+		stackParamIndex     = 3
+	)
+	recoveredName := patchParamName(patchFunc, recoveredParamIndex)
+	if recoveredName == "" {
+		// recovered value is ignored by patch, but it is still needed to re-panic
+		recoveredName = recoveredVarName
+	}
+	stmts := make([]ast.Stmt, 0, 4+len(patchFunc.Body.List))
+	stmts = append(stmts, createSpanStmt(source.spanName, patchFunc))
+	stmts = append(stmts, createPatchCtxDefStmts(source.ctx, patchParamName(patchFunc, ctxParamIndex))...)
+	if stackName := patchParamName(patchFunc, stackParamIndex); stackName != "" {
+		stmts = append(stmts, &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent(stackName)},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun: &ast.SelectorExpr{X: ast.NewIdent(nativeDebugPkgName), Sel: ast.NewIdent("Stack")},
+			}},
+		})
+	}
+	stmts = append(stmts, patchFunc.Body.List...)
+	stmts = append(stmts, &ast.ExprStmt{X: &ast.CallExpr{
+		Fun:  ast.NewIdent("panic"),
+		Args: []ast.Expr{ast.NewIdent(recoveredName)},
+	}})
+	ifStmt := &ast.IfStmt{
+		Init: &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent(recoveredName)},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("recover")}},
+		},
+		Cond: &ast.BinaryExpr{X: ast.NewIdent(recoveredName), Op: token.NEQ, Y: ast.NewIdent("nil")},
+		Body: &ast.BlockStmt{List: stmts},
 	}
-	return ""
+	return []ast.Stmt{createDeferFuncLitStmt([]ast.Stmt{ifStmt})}
+}
+
+// patchParamName get name of i-th param of patch function, empty string returned if param is ignored
+func patchParamName(patchFunc *ast.FuncDecl, i int) string {
+	paramNames := patchFunc.Type.Params.List[i].Names
+	if len(paramNames) == 0 || isBlankIdent(paramNames[0].Name) {
+		return ""
+	}
+	return paramNames[0].Name
+}
+
+// patchParamLazy i-th param of patch function is in lazy form func() []interface{}
+func patchParamLazy(patchFunc *ast.FuncDecl, i int) bool {
+	return filter.IsLazyArgsType(patchFunc.Type.Params.List[i].Type)
 }
 
 func createSpanStmt(spanName string, patchFunc *ast.FuncDecl) *ast.AssignStmt {
@@ -82,117 +304,171 @@ func createSpanStmt(spanName string, patchFunc *ast.FuncDecl) *ast.AssignStmt {
 		},
 		Tok: token.DEFINE,
 		Rhs: []ast.Expr{
-			&ast.BasicLit{Kind: token.STRING, Value: "\"" + spanName + "\""},
+			&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(spanName)},
 		},
 	}
 }
 
-func createHasCtxDefStmt(source *ast.FuncDecl, patchFunc *ast.FuncDecl) *ast.AssignStmt {
-	paramNames := patchFunc.Type.Params.List[1].Names
-	if len(paramNames) == 0 || isBlankIdent(paramNames[0].Name) {
+func createHasCtxDefStmt(ctx sourceCtx, paramName string) *ast.AssignStmt {
+	if paramName == "" {
 		return nil
 	}
-	hasCtxVal := "true"
-	ctxParamName := getCtxParamName(source)
-	if ctxParamName == "" || isBlankIdent(ctxParamName) {
-		hasCtxVal = "false"
+	var hasCtxVal ast.Expr = ast.NewIdent("true")
+	switch {
+	case !ctx.exists():
+		hasCtxVal = ast.NewIdent("false")
+	case ctx.nilable:
+		// hasCtxSuffix := r != nil
+		hasCtxVal = ctx.notNilExpr()
 	}
 	return &ast.AssignStmt{
 		Lhs: []ast.Expr{
-			ast.NewIdent(paramNames[0].Name),
+			ast.NewIdent(paramName),
 		},
 		Tok: token.DEFINE,
 		Rhs: []ast.Expr{
-			ast.NewIdent(hasCtxVal),
+			hasCtxVal,
 		},
 	}
 }
 
-// createPatchCtxDefStmt create ctx assign stmt for source function if patch func do not ignore ctx param
-func createPatchCtxDefStmt(source, patchFunc *ast.FuncDecl) *ast.AssignStmt {
-	paramNames := patchFunc.Type.Params.List[2].Names
-	if len(paramNames) == 0 || isBlankIdent(paramNames[0].Name) {
+// createPatchCtxDefStmts create ctx assign stmts for source function if patch func do not ignore ctx param
+func createPatchCtxDefStmts(ctx sourceCtx, paramName string) []ast.Stmt {
+	if paramName == "" {
 		return nil
 	}
 	// source: has ctx
 	// source: no ctx
-	sourceCtxName := getCtxParamName(source)
+	// source: nilable ctx param, ctxSuffix := gonativectx.Background(); if r != nil { ctxSuffix = r.Context() }
 	ctxAssignStmt := &ast.AssignStmt{
 		Lhs: []ast.Expr{
-			ast.NewIdent(paramNames[0].Name),
+			ast.NewIdent(paramName),
 		},
 		Tok: token.DEFINE,
 	}
-	if sourceCtxName != "" && !isBlankIdent(sourceCtxName) {
+	if ctx.exists() && !ctx.nilable {
 		ctxAssignStmt.Rhs = []ast.Expr{
-			ast.NewIdent(sourceCtxName),
+			ctx.valueExpr(),
 		}
 	} else {
 		ctxAssignStmt.Rhs = []ast.Expr{
 			&ast.CallExpr{
 				Fun: &ast.SelectorExpr{
-					X:   ast.NewIdent("gonativectx"),
+					X:   ast.NewIdent(nativeCtxPkg),
 					Sel: ast.NewIdent("Background"),
 				},
 			},
 		}
 	}
-	return ctxAssignStmt
+	stmts := []ast.Stmt{ctxAssignStmt}
+	if ctx.exists() && ctx.nilable {
+		stmts = append(stmts, ctx.guard(&ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent(paramName)},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{ctx.valueExpr()},
+		}))
+	}
+	return stmts
 }
 
-func createArgsDefStmt(source, patchFunc *ast.FuncDecl) *ast.AssignStmt {
-	paramNames := patchFunc.Type.Params.List[3].Names
-	if len(paramNames) == 0 || isBlankIdent(paramNames[0].Name) {
+func createArgsDefStmt(funcType *ast.FuncType, paramName string, lazy bool) *ast.AssignStmt {
+	names, _ := sourceArgs(funcType)
+	return createInterfaceSliceDefStmt(names, paramName, lazy)
+}
+
+// createFuncDescDefStmt create paramName := desc, desc is package level var of func descriptor
+func createFuncDescDefStmt(desc, paramName string) *ast.AssignStmt {
+	if desc == "" || paramName == "" {
 		return nil
 	}
+	return &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent(paramName)},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{ast.NewIdent(desc)},
+	}
+}
 
+// createInterfaceSliceDefStmt create paramName := []interface{}{names...}, or
+// paramName := func() []interface{} { return []interface{}{names...} } if lazy, so values are boxed only when
+// patch body calls it
+func createInterfaceSliceDefStmt(names []string, paramName string, lazy bool) *ast.AssignStmt {
+	if paramName == "" {
+		return nil
+	}
 	var elts []ast.Expr
-	for _, field := range source.Type.Params.List {
-		for _, name := range field.Names {
-			if isBlankIdent(name.Name) {
-				continue
-			}
-			elts = append(elts, ast.NewIdent(name.Name))
+	for _, name := range names {
+		elts = append(elts, ast.NewIdent(name))
+	}
+	var value ast.Expr = &ast.CompositeLit{Type: interfaceSliceType(), Elts: elts}
+	if lazy {
+		value = &ast.FuncLit{
+			Type: &ast.FuncType{
+				Params:  &ast.FieldList{},
+				Results: &ast.FieldList{List: []*ast.Field{{Type: interfaceSliceType()}}},
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{Results: []ast.Expr{value}}}},
 		}
 	}
 	return &ast.AssignStmt{
 		Lhs: []ast.Expr{
-			ast.NewIdent(paramNames[0].Name),
+			ast.NewIdent(paramName),
 		},
 		Tok: token.DEFINE,
-		Rhs: []ast.Expr{
-			&ast.CompositeLit{
-				Type: &ast.ArrayType{
-					Elt: &ast.InterfaceType{
-						Methods: &ast.FieldList{},
-					},
-				},
-				Elts: elts,
+		Rhs: []ast.Expr{value},
+	}
+}
+
+// interfaceSliceType []interface{}
+func interfaceSliceType() *ast.ArrayType {
+	return &ast.ArrayType{
+		Elt: &ast.InterfaceType{
+			Methods: &ast.FieldList{},
+		},
+	}
+}
+
+// createErrDefStmt create var paramName error = lastErrorResult, or var paramName error if no error result
+func createErrDefStmt(results []resultVar, paramName string) *ast.DeclStmt {
+	if paramName == "" {
+		return nil
+	}
+	spec := &ast.ValueSpec{
+		Names: []*ast.Ident{ast.NewIdent(paramName)},
+		Type:  ast.NewIdent("error"),
+	}
+	if n := len(results); n > 0 && results[n-1].isError {
+		spec.Values = []ast.Expr{ast.NewIdent(results[n-1].name)}
+	}
+	return &ast.DeclStmt{
+		Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{spec},
+		},
+	}
+}
+
+// createDeferFuncLitStmt create defer func() { stmts... }()
+func createDeferFuncLitStmt(stmts []ast.Stmt) *ast.DeferStmt {
+	return &ast.DeferStmt{
+		Call: &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Params: &ast.FieldList{}},
+				Body: &ast.BlockStmt{List: stmts},
 			},
 		},
 	}
 }
 
 // createSourceCtxAssignStmt create source ctx assign stmt if patch func do not ignore ctx param
-func createSourceCtxAssignStmt(source, patchFunc *ast.FuncDecl) *ast.AssignStmt {
-	paramNames := patchFunc.Type.Params.List[2].Names
-	if len(paramNames) == 0 || isBlankIdent(paramNames[0].Name) {
+func createSourceCtxAssignStmt(ctx sourceCtx, paramName string) ast.Stmt {
+	if paramName == "" {
 		return nil
 	}
 	// source: has ctx
 	// source: no ctx
-	sourceCtxName := getCtxParamName(source)
-	if sourceCtxName == "" || isBlankIdent(sourceCtxName) {
+	if !ctx.exists() {
 		return nil
 	}
-	ctxAssignStmt := &ast.AssignStmt{
-		Lhs: []ast.Expr{
-			ast.NewIdent(sourceCtxName),
-		},
-		Tok: token.ASSIGN,
-		Rhs: []ast.Expr{
-			ast.NewIdent(paramNames[0].Name),
-		},
-	}
-	return ctxAssignStmt
+	// ctx = ctxSuffix, or r = r.WithContext(ctxSuffix), which is guarded by nil check of r
+	return ctx.guard(ctx.propagateStmt(paramName))
 }
@@ -1,35 +1,35 @@
 package rewriter
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
 
 	"github.com/jattle/go-instrumentation/instrument/parser"
 	"github.com/jattle/go-instrumentation/instrument/printer"
 )
 
-func getImportDecls(source parser.FileMeta) []*ast.GenDecl {
+// getImportDecls get import decls of file, decls in marked blocks are ignored
+func getImportDecls(source parser.FileMeta, blocks []markedBlock) []*ast.GenDecl {
 	decls := make([]*ast.GenDecl, 0)
 	for _, decl := range source.ASTFile.Decls {
-		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT {
+		if genDecl, ok := decl.(*ast.GenDecl); ok && genDecl.Tok == token.IMPORT &&
+			!inBlocks(blocks, source.FSet.Position(genDecl.Pos()).Offset) {
 			decls = append(decls, genDecl)
 		}
 	}
 	return decls
 }
 
-func createNewImportDecl(source parser.FileMeta, patches []parser.FileMeta) (edit Edit, err error) {
-	decl := ast.GenDecl{Tok: token.IMPORT}
-	for _, patch := range patches {
-		patchImportDecls := getImportDecls(patch)
-		traverseDeclSpecs(patchImportDecls, func(spec ast.Spec) {
-			decl.Specs = append(decl.Specs, spec)
-		})
+func newImportSpec(name, path string) *ast.ImportSpec {
+	spec := &ast.ImportSpec{Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(path)}}
+	if name != "" {
+		spec.Name = ast.NewIdent(name)
 	}
-	// source file has no imports, we could simply place auto-generated imports just below package xxx
-	// if we delete all old imports, set offset as the lowest offset
-	edit, err = newImportEdit(source, &decl)
-	return
+	return spec
 }
 
 func newImportEdit(source parser.FileMeta, decl *ast.GenDecl) (edit Edit, err error) {
@@ -37,85 +37,199 @@ func newImportEdit(source parser.FileMeta, decl *ast.GenDecl) (edit Edit, err er
 	edit.OpType = EditTypeAdd
 	edit.BeginPos = newImportOffset
 	edit.EndPos = newImportOffset
-	edit.Content, err = printer.PrintAstNode(decl, 0)
+	var content []byte
+	if content, err = printer.PrintAstNode(decl, 0); err != nil {
+		return
+	}
+	// wrap imports with markers, ignore leading char '\n'
+	edit.Content = append(markBlock(importMarkerName, 0, content[1:]),
+		lineDirective(source, source.ASTFile.Name.Pos()+token.Pos(len(source.ASTFile.Name.Name)+1), 0)...)
 	return
 }
 
-type importMeta struct {
-	name, path string
+func traverseDeclSpecs(decls []*ast.GenDecl, f func(spec ast.Spec)) {
+	for _, decl := range decls {
+		for _, spec := range decl.Specs {
+			f(spec)
+		}
+	}
 }
 
-func insertSpec(importsMap map[importMeta]struct{}, spec *ast.ImportSpec) bool {
-	var name string
+// importName name of imported package used in file, package name of import without alias is resolved by
+// type information if possible, otherwise it is assumed to be the last element of import path,
+// eg: gopkg.in/yaml.v3 => yaml, github.com/goccy/go-json => json, github.com/a/b/v2 => b
+func importName(meta parser.FileMeta, spec *ast.ImportSpec) string {
 	if spec.Name != nil {
-		name = spec.Name.Name
+		return spec.Name.Name
 	}
-	meta := importMeta{name: name, path: spec.Path.Value}
-	if _, ok := importsMap[meta]; !ok {
-		importsMap[meta] = struct{}{}
-		return true
+	if meta.TypesInfo != nil {
+		if pkgName, ok := meta.TypesInfo.Implicits[spec].(*types.PkgName); ok {
+			return pkgName.Imported().Name()
+		}
 	}
-	return false
+	importPath, _ := strconv.Unquote(spec.Path.Value)
+	return guessPackageName(importPath)
 }
 
-func traverseDeclSpecs(decls []*ast.GenDecl, f func(spec ast.Spec)) {
-	for _, decl := range decls {
-		for _, spec := range decl.Specs {
-			f(spec)
+func guessPackageName(importPath string) string {
+	elems := strings.Split(importPath, "/")
+	name := elems[len(elems)-1]
+	// major version suffix, eg: github.com/a/b/v2
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	if i := strings.IndexAny(name, ".-"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// importPlan imports of patches resolved against imports of source file
+type importPlan struct {
+	// specs imports to add into source file
+	specs []*ast.ImportSpec
+	// aliases package names of patch code renamed in source file, indexed by patch
+	aliases []map[string]string
+}
+
+// planImports resolve imports of patches and imports needed by generated code, only imports referenced by injected
+// code are planned, refs are referenced package names indexed by patch, nil if patch is not injected.
+// imports of source file are reused if they have the same path, otherwise patch imports are added, and re-aliased
+// if their names clash with names of source file imports or file scope decls, imports in blocks are ignored
+// since they will be deleted.
+func planImports(source parser.FileMeta, blocks []markedBlock, patchSet *PatchSet, file fileScope,
+	refs []map[string]struct{}) importPlan {
+	plan := importPlan{aliases: make([]map[string]string, len(patchSet.Patches))}
+	// names of imported packages in source file
+	taken := make(map[string]struct{})
+	for name := range file {
+		taken[name] = struct{}{}
+	}
+	// path => name of packages which can be referenced by injected code
+	pathNames := make(map[string]string)
+	// imports without name to reference, blank or dot imports
+	anonymous := make(map[[2]string]struct{})
+	traverseDeclSpecs(getImportDecls(source, blocks), func(spec ast.Spec) {
+		importSpec := spec.(*ast.ImportSpec)
+		if inBlocks(blocks, source.FSet.Position(spec.Pos()).Offset) {
+			return
+		}
+		importPath, _ := strconv.Unquote(importSpec.Path.Value)
+		name := importName(source, importSpec)
+		if name == "_" || name == "." {
+			anonymous[[2]string{name, importPath}] = struct{}{}
+			return
+		}
+		taken[name] = struct{}{}
+		if _, ok := pathNames[importPath]; !ok {
+			pathNames[importPath] = name
 		}
+	})
+	for i, patch := range patchSet.Patches {
+		plan.aliases[i] = make(map[string]string)
+		if refs[i] == nil {
+			continue
+		}
+		for _, spec := range patchSet.importSpecs(i) {
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			name := importName(patch, spec)
+			if name == "_" || name == "." {
+				// usage can not be detected, add them if patch is injected
+				if _, ok := anonymous[[2]string{name, importPath}]; !ok {
+					anonymous[[2]string{name, importPath}] = struct{}{}
+					plan.specs = append(plan.specs, newImportSpec(name, importPath))
+				}
+				continue
+			}
+			if _, ok := refs[i][name]; !ok {
+				// unused import
+				continue
+			}
+			target, ok := pathNames[importPath]
+			if !ok {
+				// re-alias import whose name clashes
+				target = name
+				for n := 1; ; n++ {
+					if _, ok := taken[target]; !ok {
+						break
+					}
+					target = fmt.Sprintf("%s%d", name, n)
+				}
+				alias := target
+				if spec.Name == nil && target == name {
+					alias = ""
+				}
+				plan.specs = append(plan.specs, newImportSpec(alias, importPath))
+				taken[target] = struct{}{}
+				pathNames[importPath] = target
+			}
+			if target != name {
+				plan.aliases[i][name] = target
+			}
+		}
+	}
+	return plan
+}
+
+// renamePackageRefs rename package names referenced by selector expressions of stmts,
+// package names are identifiers which are not resolved to any object, eg: fmt of fmt.Println
+func renamePackageRefs(stmts []ast.Stmt, aliases map[string]string) {
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			if sel, ok := node.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+					if alias, ok := aliases[x.Name]; ok {
+						x.Name = alias
+					}
+				}
+			}
+			return true
+		})
 	}
 }
 
-func mergeImports(source parser.FileMeta, patches []parser.FileMeta) (edits []Edit, err error) {
+// mergeImports add planned imports into source file
+func mergeImports(source parser.FileMeta, specs []*ast.ImportSpec, blocks []markedBlock) (edits []Edit, err error) {
 	// three cases
 	// 1. source file has no imports --> create
 	// 2. source file has many separate imports, multiline --> add new
 	// 3. source file has only one import
 	//    one spec --> merge
-	//    multi spec --> add before ')'
-	sourceImportDecls := getImportDecls(source)
+	//    multi spec --> add after '('
+	if len(specs) == 0 {
+		return
+	}
+	sourceImportDecls := getImportDecls(source, blocks)
+	var sourceSpecNum int
+	traverseDeclSpecs(sourceImportDecls, func(spec ast.Spec) {
+		if !inBlocks(blocks, source.FSet.Position(spec.Pos()).Offset) {
+			sourceSpecNum++
+		}
+	})
+	additionalImportDecl := ast.GenDecl{Tok: token.IMPORT}
+	for _, spec := range specs {
+		additionalImportDecl.Specs = append(additionalImportDecl.Specs, spec)
+	}
 	var edit Edit
-	if len(sourceImportDecls) == 0 {
-		edit, err = createNewImportDecl(source, patches)
+	if len(sourceImportDecls) == 1 && sourceSpecNum > 1 {
+		// import ()
+		edit.OpType = EditTypeAdd
+		pos := source.FSet.Position(sourceImportDecls[0].Lparen).Offset + 1
+		edit.BeginPos = pos
+		edit.EndPos = pos
+		// add after (, line directive followed by ) would be indented by gofmt and ignored by compiler
+		var content []byte
+		content, err = printer.PrintAstNodes(additionalImportDecl.Specs, 1)
+		edit.Content = append(markBlock(importMarkerName, 1, content), lineDirective(source,
+			sourceImportDecls[0].Lparen+1, 0)...)
 	} else {
-		importsMap := make(map[importMeta]struct{})
-		traverseDeclSpecs(sourceImportDecls, func(spec ast.Spec) {
-			insertSpec(importsMap, spec.(*ast.ImportSpec))
-		})
-		additionalImportDecl := ast.GenDecl{Tok: token.IMPORT}
-		for _, patch := range patches {
-			patchImportDecls := getImportDecls(patch)
-			traverseDeclSpecs(patchImportDecls, func(spec ast.Spec) {
-				// two import specs equal if both name and path equal
-				if insertSpec(importsMap, spec.(*ast.ImportSpec)) {
-					// only save import not in source file
-					additionalImportDecl.Specs = append(additionalImportDecl.Specs, spec)
-				}
-			})
-		}
-		// single import, import "xxx" or import ()
-		if len(sourceImportDecls) == 1 {
-			if len(sourceImportDecls[0].Specs) == 1 {
-				// import "xxx"
-				// add below package xxx
-				edit, err = newImportEdit(source, &additionalImportDecl)
-			} else {
-				// import ()
-				edit.OpType = EditTypeAdd
-				pos := source.FSet.Position(sourceImportDecls[0].Rparen).Offset
-				edit.BeginPos = pos
-				edit.EndPos = pos
-				// add before )
-				edit.Content, err = printer.PrintAstNodes(additionalImportDecl.Specs, 1)
-			}
-		} else {
-			// multi-imports
-			// import "a"
-			// import "b"
-			// import "c"
-			// add below package xxx
-			edit, err = newImportEdit(source, &additionalImportDecl)
-		}
+		// no imports, or single import "xxx", or multi-imports
+		// import "a"
+		// import "b"
+		// import "c"
+		// add below package xxx
+		edit, err = newImportEdit(source, &additionalImportDecl)
 	}
 	if err != nil {
 		return
@@ -3,38 +3,84 @@ package rewriter
 import (
 	"fmt"
 	"go/ast"
+	"path"
+	"path/filepath"
 
 	"github.com/jattle/go-instrumentation/instrument/filter"
 	"github.com/jattle/go-instrumentation/instrument/parser"
 	"github.com/jattle/go-instrumentation/internal/instrument/astvisitor"
 )
 
+// NamingStrategy strategy of generating suffix for renamed vars of patch functions
+type NamingStrategy int
+
+const (
+	// NamingHash deterministic suffix, hash of patch file name and patch function name,
+	// same patch always generates same names, so instrumentation results are stable
+	NamingHash NamingStrategy = iota
+	// NamingTime suffix of timestamp and global counter, names differ in every instrumentation
+	NamingTime
+)
+
 // RewritePatchASTFunc rewrite patch file ast, mainly replace local vars, function args, names return vars
 func RewritePatchASTFunc(patch parser.FileMeta) (instrumenterFuncs []*ast.FuncDecl, err error) {
+	return rewritePatchAST(patch, NamingHash)
+}
+
+func rewritePatchAST(patch parser.FileMeta, naming NamingStrategy) (instrumenterFuncs []*ast.FuncDecl, err error) {
 	instrumenterFuncs = filter.SelectInstrumentFuncDecls(patch.ASTFile.Decls)
 	if len(instrumenterFuncs) == 0 {
 		err = fmt.Errorf("instrument func decl not found")
 		return
 	}
 	for _, decl := range instrumenterFuncs {
-		varMappings := genFuncVarNameMapping(patch, decl)
-		if err = renameFuncVars(decl, varMappings); err != nil {
+		if err = rewritePatchFunc(patch, decl, 0, naming); err != nil {
 			return
 		}
 	}
 	return
 }
 
-func genFuncVarNameMapping(meta parser.FileMeta, decl *ast.FuncDecl) map[string]string {
+// rewritePatchFunc rename vars of patch function with suffix generated by salt
+func rewritePatchFunc(patch parser.FileMeta, decl *ast.FuncDecl, salt int, naming NamingStrategy) error {
+	varMappings := genFuncVarNameMapping(patch, decl, salt, naming)
+	return renameFuncVars(decl, varMappings)
+}
+
+func genFuncVarNameMapping(meta parser.FileMeta, decl *ast.FuncDecl, salt int,
+	naming NamingStrategy) map[string]string {
 	vars, _ := astvisitor.CollectFuncVars(decl)
+	// labels of entry patches are in the same scope with labels of source function, rename them too
+	for label := range astvisitor.CollectFuncLabels(decl) {
+		vars[label] = struct{}{}
+	}
 	varMappings := make(map[string]string)
-	suffix := astvisitor.GenVarSuffix(meta.FileName)
+	suffix := genVarSuffix(patchPath(meta.FileName), decl.Name.Name, salt, naming)
 	for k := range vars {
 		varMappings[k] = k + suffix
 	}
 	return varMappings
 }
 
+// patchPath import path of patch file, eg: github.com/a/b/patches/trace.go, so it is the same for every checkout
+// of module, absolute path is used if it is not in a module
+func patchPath(filename string) string {
+	if pkgPath := parser.PackagePath(filepath.Dir(filename)); pkgPath != "" {
+		return path.Join(pkgPath, filepath.Base(filename))
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		return filepath.ToSlash(abs)
+	}
+	return filename
+}
+
+func genVarSuffix(patch, funcName string, salt int, naming NamingStrategy) string {
+	if naming == NamingTime {
+		return astvisitor.GenVarSuffix(patch)
+	}
+	return astvisitor.GenHashVarSuffix(patch, funcName, salt)
+}
+
 func renameFuncVars(funcDecl *ast.FuncDecl, vars map[string]string) error {
 	ast.Inspect(funcDecl, func(node ast.Node) bool {
 		switch n := node.(type) {
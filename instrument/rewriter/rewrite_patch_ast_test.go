@@ -2,6 +2,8 @@ package rewriter
 
 import (
 	"go/ast"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jattle/go-instrumentation/instrument/filter"
@@ -44,3 +46,16 @@ func TestRewritePatchASTFunc(t *testing.T) {
 	assert.Equal(t, param1, "filename")
 	assert.Equal(t, param2, "functionname")
 }
+
+func TestPatchPath(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/p\n"), 0644))
+	// patches with the same file name in different dirs get different var suffixes
+	a, b := patchPath(filepath.Join(dir, "a", "trace.go")), patchPath(filepath.Join(dir, "b", "trace.go"))
+	assert.Equal(t, a, "example.com/p/a/trace.go")
+	assert.Equal(t, b, "example.com/p/b/trace.go")
+	assert.Assert(t, genVarSuffix(a, "Trace", 0, NamingHash) != genVarSuffix(b, "Trace", 0, NamingHash))
+	// absolute path is used out of module
+	outside := filepath.Join(t.TempDir(), "trace.go")
+	assert.Equal(t, patchPath(outside), filepath.ToSlash(outside))
+}
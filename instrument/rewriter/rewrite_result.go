@@ -0,0 +1,74 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+const (
+	// resultNamePrefix name prefix of unnamed result in parenthesized result list, eg: (int, error)
+	resultNamePrefix = "instrumentResult"
+	// blankResultNamePrefix name prefix of blank result, eg: (_ int, err error)
+	blankResultNamePrefix = "instrumentBlankResult"
+	// bareResultNamePrefix name prefix of single unparenthesized result, eg: func foo() error
+	bareResultNamePrefix = "instrumentBareResult"
+)
+
+// resultVar named result of source function
+type resultVar struct {
+	name    string
+	isError bool
+}
+
+// nameSourceResults name every result of source function, so deferred exit patches can see final results,
+// even if source function returns with bare return. edits for unnamed or blank results are generated,
+// named results are kept as is.
+func nameSourceResults(srcMeta parser.FileMeta, funcType *ast.FuncType) (results []resultVar, edits []Edit) {
+	fields := funcType.Results
+	if fields == nil || len(fields.List) == 0 {
+		return
+	}
+	for _, field := range fields.List {
+		isError := isErrorType(field.Type)
+		if len(field.Names) == 0 {
+			// unnamed result, only one type in this field
+			index := len(results)
+			pos := srcMeta.FSet.Position(field.Type.Pos()).Offset
+			var name string
+			if !fields.Opening.IsValid() {
+				// func foo() error => func foo() (instrumentBareResult0 error)
+				name = fmt.Sprintf("%s%d", bareResultNamePrefix, index)
+				end := srcMeta.FSet.Position(field.Type.End()).Offset
+				edits = append(edits, newAddEdit(pos, []byte("("+name+" ")), newAddEdit(end, []byte(")")))
+			} else {
+				// func foo() (int, error) => func foo() (instrumentResult0 int, instrumentResult1 error)
+				name = fmt.Sprintf("%s%d", resultNamePrefix, index)
+				edits = append(edits, newAddEdit(pos, []byte(name+" ")))
+			}
+			results = append(results, resultVar{name: name, isError: isError})
+			continue
+		}
+		for _, ident := range field.Names {
+			name := ident.Name
+			if isBlankIdent(name) {
+				// blank result can not be referenced, rename it
+				name = fmt.Sprintf("%s%d", blankResultNamePrefix, len(results))
+				pos := srcMeta.FSet.Position(ident.Pos()).Offset
+				edits = append(edits, Edit{OpType: EditTypeReplace, BeginPos: pos, EndPos: pos, Content: []byte(name)})
+			}
+			results = append(results, resultVar{name: name, isError: isError})
+		}
+	}
+	return
+}
+
+func newAddEdit(pos int, content []byte) Edit {
+	return Edit{OpType: EditTypeAdd, BeginPos: pos, EndPos: pos, Content: content}
+}
+
+func isErrorType(t ast.Expr) bool {
+	ident, ok := t.(*ast.Ident)
+	return ok && ident.Name == "error"
+}
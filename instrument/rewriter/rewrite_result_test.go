@@ -0,0 +1,75 @@
+package rewriter
+
+import (
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"gotest.tools/assert"
+)
+
+func TestNameSourceResults(t *testing.T) {
+	content := `package main
+
+func a() error { return nil }
+
+func b() (int, error) { return 0, nil }
+
+func c() (n int, _ error) { return }
+
+func d() {}
+`
+	cases := []struct {
+		funcName        string
+		names           []string
+		isErrors        []bool
+		expectedContent string
+	}{
+		{
+			funcName:        "a",
+			names:           []string{"instrumentBareResult0"},
+			isErrors:        []bool{true},
+			expectedContent: "func a() (instrumentBareResult0 error) { return nil }",
+		},
+		{
+			funcName:        "b",
+			names:           []string{"instrumentResult0", "instrumentResult1"},
+			isErrors:        []bool{false, true},
+			expectedContent: "func b() (instrumentResult0 int, instrumentResult1 error) { return 0, nil }",
+		},
+		{
+			funcName:        "c",
+			names:           []string{"n", "instrumentBlankResult1"},
+			isErrors:        []bool{false, true},
+			expectedContent: "func c() (n int, instrumentBlankResult1 error) { return }",
+		},
+		{
+			funcName:        "d",
+			expectedContent: "func d() {}",
+		},
+	}
+	meta, err := parser.ParseContent("main.go", []byte(content))
+	assert.NilError(t, err)
+	for _, c := range cases {
+		t.Run(c.funcName, func(t *testing.T) {
+			funcs := filter.SelectFuncDecls(meta.ASTFile.Decls, getFuncByName(c.funcName))
+			assert.Equal(t, len(funcs), 1)
+			results, edits := nameSourceResults(meta, funcs[0].Type)
+			assert.Equal(t, len(results), len(c.names))
+			for i, r := range results {
+				assert.Equal(t, r.name, c.names[i])
+				assert.Equal(t, r.isError, c.isErrors[i])
+			}
+			begin := meta.FSet.Position(funcs[0].Pos()).Offset
+			end := meta.FSet.Position(funcs[0].End()).Offset
+			for i := range edits {
+				edits[i].BeginPos -= begin
+				edits[i].EndPos -= begin
+			}
+			f := FileRewriter{Content: meta.Content[begin:end], Edits: edits}
+			rewritten, err := f.Rewrite()
+			assert.NilError(t, err)
+			assert.Equal(t, string(rewritten), c.expectedContent)
+		})
+	}
+}
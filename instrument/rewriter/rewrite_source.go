@@ -1,104 +1,297 @@
 package rewriter
 
 import (
+	"errors"
 	"fmt"
 	"go/ast"
-	"path"
+	"strings"
 
 	"github.com/jattle/go-instrumentation/instrument/filter"
 	"github.com/jattle/go-instrumentation/instrument/parser"
 )
 
-// RewriteSourceFile for every patch file, patch instrumenter func to source file ast,
+// RewriteSourceFile for every patch func of options, patch instrumenter func to source file ast,
 // for each patch one edition for source code is generated, both for function and imports, finally all editions
 // will be applied for this file, source file content will be merged with edited contents.
-func RewriteSourceFile(source *parser.FileMeta, patches []parser.FileMeta) error {
-	// collect patch funcs
-	patchFuncs := make([]*ast.FuncDecl, 0, len(patches))
-	for i := range patches {
-		if funcDecls, err := RewritePatchASTFunc(patches[i]); err == nil {
-			patchFuncs = append(patchFuncs, funcDecls...)
+func RewriteSourceFile(source *parser.FileMeta, opts Options) error {
+	_, err := RewriteSourceFileWithResult(source, opts)
+	return err
+}
+
+// RewriteSourceFileWithResult same as RewriteSourceFile, and report instrumented and skipped functions,
+// no function is reported as instrumented if error is returned, since source content is not rewritten
+func RewriteSourceFileWithResult(source *parser.FileMeta, opts Options) (result FileResult, err error) {
+	defer func() {
+		if err != nil {
+			result.Funcs = nil
 		}
+	}()
+	opts, err = opts.withDefaults()
+	if err != nil {
+		return
+	}
+	patchSet := opts.PatchSet
+	// blocks injected by previous instrumentation are replaced, so instrumentation is idempotent
+	blocks, err := findMarkedBlocks(*source)
+	if err != nil {
+		return
 	}
-	if len(patchFuncs) == 0 {
-		return fmt.Errorf("no valid patch func found")
+	sourceFuncs, skipped, err := collectSourceFuncs(*source, blocks, opts)
+	if err != nil {
+		return
 	}
-	sourceFuncs := getFuncDecls(source.ASTFile.Decls)
+	result.Skipped = skipped
 	// cant find any function declaration, do not need to rewrite
-	if len(sourceFuncs) == 0 {
-		return nil
+	if len(sourceFuncs) == 0 && len(blocks) == 0 {
+		return
+	}
+	edits := make([]Edit, 0, len(blocks))
+	for _, block := range blocks {
+		edits = append(edits, delBlockEdit(block))
+	}
+	fileScope := newFileScope(*source, blocks)
+	var (
+		injections []patchInjection
+		descs      []funcDesc
+		importPath string
+	)
+	if opts.SpanNameTemplate != nil {
+		importPath = sourceImportPath(*source)
 	}
-	var edits []Edit
-	var rewriteNum int
-	for _, funcDecl := range sourceFuncs {
-		if !filter.DefaultFuncFilter()(funcDecl) {
+	for _, fn := range sourceFuncs {
+		funcResult := FuncResult{Name: fn.name, Pos: source.FSet.Position(fn.node.Pos())}
+		spanName, err := genSpanName(opts.SpanNameTemplate, spanNameData(importPath, source.ASTFile.Name.Name,
+			source.FileName, funcResult.Pos.Line, fn.name), fn.name)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", funcResult.Pos, err)
+		}
+		funcResult.SpanName = spanName
+		patchFuncs, err := patchSet.funcsNamed(patchSet.funcsOf(fn.patches), fn.patchNames)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", funcResult.Pos, err)
+		}
+		switch {
+		case fn.body == nil:
+			funcResult.SkipReason = SkipReasonNoFuncBody
+		case len(patchFuncs) == 0:
+			funcResult.SkipReason = SkipReasonNoPatch
+		}
+		if funcResult.SkipReason != "" {
+			result.Skipped = append(result.Skipped, funcResult)
 			continue
 		}
-		rewriteNum++
+		sourceFunc := sourceFuncMeta{
+			spanName: spanName,
+			funcType: fn.funcType,
+			body:     fn.body,
+			ctx:      resolveSourceCtx(*source, fn.funcType, opts.CtxAccessors),
+			// results named by previous instrumentation are not in original source
+			columnShift: columnShift(*source, restoreSourceResults(*source, fn.funcType), fn.body.Lbrace),
+		}
+		if hasFuncDesc(patchFuncs) {
+			desc := newFuncDesc(source.FileName, fn.name, funcResult.Pos.Line, fn.funcType)
+			sourceFunc.desc = desc.varName
+			descs = append(descs, desc)
+		}
+		if hasKind(patchFuncs, filter.PatchKindExit) {
+			// exit patches need named results
+			var es []Edit
+			sourceFunc.results, es = nameSourceResults(*source, fn.funcType)
+			edits = append(edits, es...)
+		}
+		scope := newFuncScope(*source, fn, blocks, fileScope)
 		for _, patchFunc := range patchFuncs {
-			// spanName = filename - pkg.function
-			spanName := genSpanName(source.FileName, source.ASTFile.Name.Name, funcDecl)
-			es, err := rewriteSourceFunc(spanName, *source, funcDecl, patchFunc)
+			// names of patch vars should not conflict with source identifiers and vars of other patches
+			patchFunc, err := patchSet.resolveNameConflicts(patchFunc, scope.idents)
 			if err != nil {
-				return err
+				return result, fmt.Errorf("%s: %w", funcResult.Pos, err)
 			}
-			edits = append(edits, es...)
+			injection := patchInjection{source: sourceFunc, scope: scope, patchFunc: patchFunc,
+				patch: patchSet.patchIndex(patchFunc)}
+			if injection.stmts = genPatchStmts(sourceFunc, patchFunc); len(injection.stmts) == 0 {
+				continue
+			}
+			injection.refs = packageRefs(injection.stmts, patchSet.importNames(injection.patch))
+			injections = append(injections, injection)
+			funcResult.Patches = append(funcResult.Patches, patchFunc.Name.Name)
 		}
+		result.Funcs = append(result.Funcs, funcResult)
 	}
-	if rewriteNum > 0 {
-		// merge imports
-		es, err := mergeImports(*source, patches)
+	if len(injections) > 0 {
+		// merge imports referenced by injected code
+		refs := make([]map[string]struct{}, len(patchSet.Patches))
+		for _, injection := range injections {
+			if injection.patch < 0 {
+				continue
+			}
+			if refs[injection.patch] == nil {
+				refs[injection.patch] = make(map[string]struct{})
+			}
+			for _, ref := range injection.refs {
+				refs[injection.patch][ref] = struct{}{}
+			}
+		}
+		plan := planImports(*source, blocks, patchSet, fileScope, refs)
+		es, err := mergeImports(*source, plan.specs, blocks)
 		if err != nil {
-			return err
+			return result, err
 		}
 		edits = append(edits, es...)
+		for _, injection := range injections {
+			es, err := injection.rewrite(*source, patchSet, plan)
+			if err != nil {
+				return result, err
+			}
+			edits = append(edits, es...)
+		}
+		if len(descs) > 0 {
+			edit, err := funcDescsEdit(*source, descs)
+			if err != nil {
+				return result, err
+			}
+			edits = append(edits, edit)
+		}
+	}
+	if len(edits) > 0 {
 		rewriter := &FileRewriter{Content: source.Content, Edits: edits}
-		if source.Content, err = rewriter.Rewrite(); err != nil {
-			return err
+		content, err := rewriter.Rewrite()
+		if err != nil {
+			return result, err
+		}
+		if opts.Verify {
+			if err = verifyRewrite(source.FileName, source.Content, content, opts.TypeChecker); err != nil {
+				var verifyErr *VerifyError
+				if !opts.Rollback || !errors.As(err, &verifyErr) {
+					return result, err
+				}
+				return rollback(result, verifyErr), nil
+			}
 		}
+		source.Content = content
 	}
-	return nil
+	return result, nil
 }
 
-func getFuncDecls(decls []ast.Decl) []*ast.FuncDecl {
-	return filter.SelectFuncDecls(decls, func(*ast.FuncDecl) bool { return true })
+// rollback report instrumented functions as skipped since rewritten source fails to compile
+func rollback(result FileResult, verifyErr *VerifyError) FileResult {
+	for _, fn := range result.Funcs {
+		result.Skipped = append(result.Skipped, FuncResult{Name: fn.Name, Pos: fn.Pos, SkipReason: SkipReasonRolledBack})
+	}
+	result.Funcs, result.VerifyErr = nil, verifyErr
+	return result
 }
 
-func genSpanName(filename, pkgName string, funcDecl *ast.FuncDecl) string {
-	return fmt.Sprintf("%s-%s.%s", path.Base(filename), pkgName, qualifiedFuncName(funcDecl))
+// RewriteSourceFileWithPatchSet same as RewriteSourceFile, but apply prepared patch set with default options
+func RewriteSourceFileWithPatchSet(source *parser.FileMeta, patchSet *PatchSet) error {
+	return RewriteSourceFile(source, Options{PatchSet: patchSet})
 }
 
-// qualifiedFuncName extract qualified function name for function
-func qualifiedFuncName(funcDecl *ast.FuncDecl) string {
-	var (
-		prefix string
-		suffix = funcDecl.Name.Name
-	)
-	// has receiver
-	if funcDecl.Recv != nil && len(funcDecl.Recv.List) > 0 {
-		f := funcDecl.Recv.List[0]
-		switch t := f.Type.(type) {
-		case *ast.Ident:
-			// value receiver
-			prefix = t.Name
-		case *ast.IndexExpr:
-			// generic func, func(r *Ring[T]) foo()
-			prefix = "*" + t.X.(*ast.Ident).Name
-		case *ast.StarExpr:
-			// pointer receiver
-			switch x := t.X.(type) {
-			case *ast.Ident:
-				prefix = "*" + x.Name
-			case *ast.IndexExpr:
-				// generic func, func(r *Ring[T]) foo()
-				prefix = "*" + x.X.(*ast.Ident).Name
+// patchInjection patch func to inject into source function
+type patchInjection struct {
+	source    sourceFuncMeta
+	scope     *funcScope
+	patchFunc *ast.FuncDecl
+	// patch index of patch func in patch set
+	patch int
+	// stmts generated for patch func
+	stmts []ast.Stmt
+	// refs package names referenced by stmts
+	refs []string
+}
+
+// rewrite generate edits of injection, package names referenced by injected code are renamed by import plan
+func (i patchInjection) rewrite(srcMeta parser.FileMeta, patchSet *PatchSet, plan importPlan) ([]Edit, error) {
+	aliases := make(map[string]string)
+	if i.patch >= 0 {
+		for _, ref := range i.refs {
+			if alias, ok := plan.aliases[i.patch][ref]; ok {
+				aliases[ref] = alias
 			}
-		default:
-			panic(fmt.Sprintf("unknown recv type: %T, field: %+v", t, f))
 		}
 	}
-	if prefix != "" {
-		prefix = "(" + prefix + ")."
+	if err := i.scope.checkPackageRefs(srcMeta, i.patchFunc, i.refs, aliases); err != nil {
+		return nil, err
+	}
+	patchFunc, comments, stmts := i.patchFunc, patchSet.commentsOf(i.patchFunc), i.stmts
+	if len(aliases) > 0 {
+		// stmts share nodes with patch func which is shared by source files, rename packages of its copy
+		var err error
+		if patchFunc, comments, err = patchSet.copyFunc(i.patchFunc); err != nil {
+			return nil, err
+		}
+		stmts = genPatchStmts(i.source, patchFunc)
+		renamePackageRefs(stmts, aliases)
+	}
+	return rewriteSourceFunc(srcMeta, i.source, patchFunc, stmts, comments)
+}
+
+// qualifiedFuncName extract qualified function name for function, eg: Foo, (T).Foo, (*T).Foo, receivers
+// of generic types and parenthesized receivers are supported, type params are included if typeParams is true,
+// eg: Foo[T], (*Map[K,V]).Get, error returned if receiver type is not supported
+func qualifiedFuncName(funcDecl *ast.FuncDecl, typeParams bool) (string, error) {
+	name := funcDecl.Name.Name
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		if typeParams && funcDecl.Type.TypeParams != nil {
+			var params []string
+			for _, field := range funcDecl.Type.TypeParams.List {
+				for _, ident := range field.Names {
+					params = append(params, ident.Name)
+				}
+			}
+			name += "[" + strings.Join(params, ",") + "]"
+		}
+		return name, nil
+	}
+	recv, err := receiverName(funcDecl.Recv.List[0].Type, typeParams)
+	if err != nil {
+		return "", err
+	}
+	return "(" + recv + ")." + name, nil
+}
+
+// receiverName name of receiver type, eg: T, *T, *Map[K,V], type params are included if typeParams is true
+func receiverName(expr ast.Expr, typeParams bool) (string, error) {
+	var prefix string
+	expr = unparen(expr)
+	if star, ok := expr.(*ast.StarExpr); ok {
+		// pointer receiver
+		prefix = "*"
+		expr = unparen(star.X)
+	}
+	var indices []ast.Expr
+	switch t := expr.(type) {
+	case *ast.IndexExpr:
+		// generic type with one type param, func (r *Ring[T]) foo()
+		expr, indices = t.X, []ast.Expr{t.Index}
+	case *ast.IndexListExpr:
+		// generic type with type params, func (m *Map[K, V]) foo()
+		expr, indices = t.X, t.Indices
+	}
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return "", fmt.Errorf("unknown recv type: %s%T", prefix, expr)
+	}
+	name := prefix + ident.Name
+	if !typeParams || len(indices) == 0 {
+		return name, nil
+	}
+	params := make([]string, 0, len(indices))
+	for _, index := range indices {
+		param, ok := index.(*ast.Ident)
+		if !ok {
+			return "", fmt.Errorf("unknown type param of recv %s: %T", name, index)
+		}
+		params = append(params, param.Name)
+	}
+	return name + "[" + strings.Join(params, ",") + "]", nil
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.X
 	}
-	return prefix + suffix
 }
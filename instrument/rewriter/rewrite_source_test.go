@@ -0,0 +1,789 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument/config"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"gotest.tools/assert"
+)
+
+const testPatchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName)
+}
+
+func Exit(spanName string, _ gonativectx.Context, err error, _ ...interface{}) {
+	fmt.Println(spanName, err)
+}
+`
+
+func newTestPatchSet(t *testing.T, contents ...string) *PatchSet {
+	patches := make([]parser.FileMeta, 0, len(contents))
+	for _, content := range contents {
+		patch, err := parser.ParseContent("patch.go", []byte(content))
+		assert.NilError(t, err)
+		patches = append(patches, patch)
+	}
+	patchSet, err := NewPatchSet(patches)
+	assert.NilError(t, err)
+	return patchSet
+}
+
+func rewriteTestSource(t *testing.T, patchSet *PatchSet, content string) string {
+	return rewriteTestSourceWithOptions(t, Options{PatchSet: patchSet}, content)
+}
+
+func rewriteTestSourceWithOptions(t *testing.T, opts Options, content string) string {
+	source, err := parser.ParseContent("source.go", []byte(content))
+	assert.NilError(t, err)
+	assert.NilError(t, RewriteSourceFile(&source, opts))
+	// rewritten source should be valid
+	_, err = parser.ParseContent("source.go", source.Content)
+	assert.NilError(t, err)
+	return string(source.Content)
+}
+
+// runTestSource instrument main.go of main package and run it, rewritten source and combined output of go run
+// are returned
+func runTestSource(t *testing.T, opts Options, content string) (rewritten, out string) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/run\n\ngo 1.20\n"), 0644))
+	source, err := parser.ParseContent("main.go", []byte(content))
+	assert.NilError(t, err)
+	assert.NilError(t, RewriteSourceFile(&source, opts))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "main.go"), source.Content, 0644))
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	assert.Assert(t, err == nil || strings.Contains(err.Error(), "exit status"), err)
+	return string(source.Content), string(output)
+}
+
+func TestRewriteSourceFileIdempotent(t *testing.T) {
+	sources := []struct {
+		content string
+		imports int
+	}{
+		{content: "package main\n\nfunc a() error { return nil }\n", imports: 1},
+		{content: "package main\n\nimport \"os\"\n\nfunc a() (int, error) {\n\treturn len(os.Args), nil\n}\n", imports: 1},
+		// fmt is imported by source file
+		{content: "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc a() {\n\tfmt.Println(os.Args)\n}\n"},
+	}
+	patchSet := newTestPatchSet(t, testPatchContent)
+	for _, source := range sources {
+		first := rewriteTestSource(t, patchSet, source.content)
+		assert.Equal(t, strings.Count(first, markerBeginPrefix+"Entry"), 1)
+		assert.Equal(t, strings.Count(first, markerBeginPrefix+"Exit"), 1)
+		assert.Equal(t, strings.Count(first, markerBeginPrefix+importMarkerName), source.imports)
+		second := rewriteTestSource(t, patchSet, first)
+		assert.Equal(t, second, first)
+	}
+}
+
+func TestFindMarkedBlocksUnmatched(t *testing.T) {
+	contents := []string{
+		"package main\n\nfunc a() {\n\t//instrument:begin Entry\n}\n",
+		"package main\n\nfunc a() {\n\t//instrument:end Entry\n}\n",
+		"package main\n\nfunc a() {\n\t//instrument:begin Entry\n\t//instrument:end Exit\n}\n",
+	}
+	for _, content := range contents {
+		meta, err := parser.ParseContent("source.go", []byte(content))
+		assert.NilError(t, err)
+		_, err = findMarkedBlocks(meta)
+		assert.Assert(t, err != nil)
+	}
+}
+
+func TestStripInstrumentation(t *testing.T) {
+	sources := []string{
+		"package main\n\nfunc a() error { return nil }\n",
+		"package main\n\nimport \"os\"\n\nfunc a() (int, error) {\n\treturn len(os.Args), nil\n}\n",
+		"package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc a() (n int, _ error) {\n\tfmt.Println(os.Args)\n\treturn\n}\n",
+	}
+	patchSet := newTestPatchSet(t, testPatchContent)
+	for _, content := range sources {
+		rewritten := rewriteTestSource(t, patchSet, content)
+		assert.Assert(t, rewritten != content)
+		source, err := parser.ParseContent("source.go", []byte(rewritten))
+		assert.NilError(t, err)
+		assert.NilError(t, StripInstrumentation(&source))
+		assert.Equal(t, string(source.Content), content)
+	}
+}
+
+func TestRewriteSourceFileNameConflict(t *testing.T) {
+	patchSet := newTestPatchSet(t, testPatchContent)
+	plain := rewriteTestSource(t, patchSet, "package main\n\nfunc a() {}\n")
+	// same patch set generates same names
+	assert.Equal(t, rewriteTestSource(t, newTestPatchSet(t, testPatchContent), "package main\n\nfunc a() {}\n"), plain)
+	entry := patchSet.Funcs[0]
+	var spanName string
+	for name := range patchSet.infos[entry].vars {
+		spanName = name
+	}
+	// source function uses the default name, another name should be generated
+	content := "package main\n\nfunc a() {\n\t" + spanName + " := 1\n\t_ = " + spanName + "\n}\n"
+	rewritten := rewriteTestSource(t, patchSet, content)
+	assert.Equal(t, strings.Count(rewritten, spanName), 2)
+}
+
+func TestRewriteSourceFilePackageShadowed(t *testing.T) {
+	patchSet := newTestPatchSet(t, testPatchContent)
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{
+			content: "package main\n\nfunc a(fmt string) {}\n",
+			err:     "source.go:3:8: package fmt referenced by patch Entry is shadowed by fmt",
+		},
+	}
+	for _, c := range cases {
+		source, err := parser.ParseContent("source.go", []byte(c.content))
+		assert.NilError(t, err)
+		assert.Error(t, RewriteSourceFileWithPatchSet(&source, patchSet), c.err)
+	}
+	// local var declared in body does not shadow injected code at the beginning of body
+	rewriteTestSource(t, patchSet, "package main\n\nfunc a() {\n\tfmt := 1\n\t_ = fmt\n}\n")
+}
+
+func TestRewriteSourceFileLabels(t *testing.T) {
+	const patchContent = `package patch
+
+import gonativectx "context"
+
+func Entry(_ string, _ bool, _ gonativectx.Context, args ...interface{}) {
+loop:
+	for range args {
+		break loop
+	}
+}
+`
+	rewritten := rewriteTestSource(t, newTestPatchSet(t, patchContent),
+		"package main\n\nfunc a(n int) {\nloop:\n\tfor {\n\t\tbreak loop\n\t}\n}\n")
+	// label of patch is renamed, source label is kept
+	assert.Equal(t, strings.Count(rewritten, "\nloop:"), 1)
+	assert.Equal(t, strings.Count(rewritten, "break looppatch"), 1)
+}
+
+func TestRewriteSourceFileImportConflict(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"encoding/json"
+)
+
+func Entry(spanName string, _ bool, ctx gonativectx.Context, args ...interface{}) {
+	_, _ = json.Marshal(args)
+	_, _ = spanName, ctx
+}
+`
+	patchSet := newTestPatchSet(t, patchContent)
+	cases := []struct {
+		content string
+		want    []string
+		absent  []string
+	}{
+		{
+			// name clash with import of another path
+			content: "package main\n\nimport json \"github.com/goccy/go-json\"\n\nvar _ = json.Marshal\n\nfunc a() {}\n",
+			want:    []string{"json1 \"encoding/json\"", "json1.Marshal(", "gonativectx \"context\""},
+		},
+		{
+			// name clash with file scope decl
+			content: "package main\n\ntype json int\n\nfunc a() {}\n",
+			want:    []string{"json1 \"encoding/json\"", "json1.Marshal("},
+		},
+		{
+			// same path imported with different name is reused
+			content: "package main\n\nimport stdctx \"context\"\n\nvar _ stdctx.Context\n\nfunc a() {}\n",
+			want:    []string{"import \"encoding/json\"", "json.Marshal(", "stdctx.Background()"},
+			absent:  []string{"gonativectx"},
+		},
+	}
+	for _, c := range cases {
+		rewritten := rewriteTestSource(t, patchSet, c.content)
+		for _, want := range c.want {
+			assert.Assert(t, strings.Contains(rewritten, want), "%s not found in:\n%s", want, rewritten)
+		}
+		for _, absent := range c.absent {
+			assert.Assert(t, !strings.Contains(rewritten, absent), "%s found in:\n%s", absent, rewritten)
+		}
+	}
+}
+
+func TestRewriteSourceFileUnusedImports(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+	"strings"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName)
+}
+
+func helper(s string) string {
+	return strings.TrimSpace(s)
+}
+`
+	patchSet := newTestPatchSet(t, patchContent)
+	rewritten := rewriteTestSource(t, patchSet, "package main\n\nfunc a() {}\n")
+	assert.Assert(t, strings.Contains(rewritten, "import \"fmt\""), rewritten)
+	// strings is only used by helper, context is not used since ctx param is ignored by patch
+	assert.Assert(t, !strings.Contains(rewritten, "\"strings\""), rewritten)
+	assert.Assert(t, !strings.Contains(rewritten, "\"context\""), rewritten)
+	// patch is not injected into function without body
+	rewritten = rewriteTestSource(t, patchSet, "package main\n\nfunc a()\n")
+	assert.Equal(t, rewritten, "package main\n\nfunc a()\n")
+}
+
+func TestRewriteSourceFileFuncLit(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, hasCtx bool, _ gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName, hasCtx)
+}
+
+func Exit(spanName string, _ gonativectx.Context, err error, _ ...interface{}) {
+	fmt.Println(spanName, err)
+}
+`
+	const content = `package main
+
+import (
+	"context"
+	"net/http"
+)
+
+var f = func() error { return nil }
+
+func Outer(ctx context.Context) {
+	go func() {
+		func() {}()
+	}()
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+}
+`
+	opts := Options{PatchSet: newTestPatchSet(t, patchContent), FuncLit: true}
+	rewritten := rewriteTestSourceWithOptions(t, opts, content)
+	for _, name := range []string{"init.func1", "Outer", "Outer.func1", "Outer.func1.1", "Outer.func2"} {
+		assert.Equal(t, strings.Count(rewritten, "\"source.go-main."+name+"\""), 2, name)
+	}
+	// ctx of Outer and request of handler are detected, request may be nil
+	assert.Equal(t, strings.Count(rewritten, ":= true"), 1)
+	assert.Equal(t, strings.Count(rewritten, ":= r != nil"), 1)
+	assert.Equal(t, rewriteTestSourceWithOptions(t, opts, rewritten), rewritten)
+	stripped, err := parser.ParseContent("source.go", []byte(rewritten))
+	assert.NilError(t, err)
+	assert.NilError(t, StripInstrumentation(&stripped))
+	assert.Equal(t, string(stripped.Content), content)
+}
+
+func TestRewriteSourceFileFuncRules(t *testing.T) {
+	// split test patch into two files
+	exitIndex, entryIndex := strings.Index(testPatchContent, "func Exit"), strings.Index(testPatchContent, "func Entry")
+	entry, err := parser.ParseContent("entry.go", []byte(testPatchContent[:exitIndex]))
+	assert.NilError(t, err)
+	exit, err := parser.ParseContent("exit.go", []byte(testPatchContent[:entryIndex]+testPatchContent[exitIndex:]))
+	assert.NilError(t, err)
+	patchSet, err := NewPatchSet([]parser.FileMeta{entry, exit})
+	assert.NilError(t, err)
+	rules, err := config.Parse([]byte(`
+patch_sets:
+  entry: [entry.go]
+  exit: [exit.go]
+rules:
+  - include: [{visibility: exported}]
+    exclude: [{receivers: ["*T"]}]
+    patch_sets: [entry]
+  - include: [{receivers: ["*T"]}]
+`), false)
+	assert.NilError(t, err)
+	rewritten := rewriteTestSourceWithOptions(t, Options{PatchSet: patchSet, FuncRules: rules},
+		"package main\n\ntype T struct{}\n\nfunc A() {}\n\nfunc (*T) B() {}\n\nfunc c() {}\n")
+	assert.Equal(t, strings.Count(rewritten, markerBeginPrefix+"Entry"), 2)
+	assert.Equal(t, strings.Count(rewritten, markerBeginPrefix+"Exit"), 1)
+	assert.Assert(t, strings.Contains(rewritten, "func c() {}"))
+}
+
+func TestRewriteSourceFileUnresolvedPackage(t *testing.T) {
+	rules, err := config.Parse([]byte(`rules: [{exclude: [{packages: [example.com/svc/gen]}]}]`), false)
+	assert.NilError(t, err)
+	opts := Options{PatchSet: newTestPatchSet(t, testPatchContent), FuncRules: rules}
+	const content = "package gen\n\nfunc A() {}\n"
+	// packages of rules can not be matched without go.mod
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "gen", "source.go")
+	source, err := parser.ParseContent(filename, []byte(content))
+	assert.NilError(t, err)
+	assert.ErrorContains(t, RewriteSourceFile(&source, opts), "import path of "+filename+" not resolved")
+	assert.Equal(t, string(source.Content), content)
+
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/svc\n"), 0644))
+	source, err = parser.ParseContent(filename, []byte(content))
+	assert.NilError(t, err)
+	result, err := RewriteSourceFileWithResult(&source, opts)
+	assert.NilError(t, err)
+	assert.Equal(t, len(result.Funcs), 0)
+	assert.Equal(t, len(result.Skipped), 1)
+	assert.Equal(t, result.Skipped[0].SkipReason, SkipReasonNoRule)
+}
+
+func TestRewriteSourceFilePatchesDirective(t *testing.T) {
+	patchSet := newTestPatchSet(t, testPatchContent)
+	rewritten := rewriteTestSource(t, patchSet,
+		"package main\n\n//instrument:patches=Exit\nfunc a() {}\n\n//instrument:patches=\nfunc b() {}\n")
+	assert.Equal(t, strings.Count(rewritten, markerBeginPrefix+"Entry"), 0)
+	assert.Equal(t, strings.Count(rewritten, markerBeginPrefix+"Exit"), 1)
+	assert.Assert(t, strings.Contains(rewritten, "func b() {}"))
+	source, err := parser.ParseContent("source.go", []byte("package main\n\n//instrument:patches=Unknown\nfunc a() {}\n"))
+	assert.NilError(t, err)
+	assert.Error(t, RewriteSourceFileWithPatchSet(&source, patchSet), "source.go:4:1: patch func Unknown not found")
+}
+
+func TestRewriteSourceFilePositions(t *testing.T) {
+	patch := `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	// entry comment
+	fmt.Println(spanName) // trailing comment
+}
+
+func Exit(spanName string, _ gonativectx.Context, err error, _ ...interface{}) {
+	fmt.Println(spanName, err)
+	// exit comment
+}
+`
+	sources := []string{
+		"package main\n\nimport \"os\"\n\nfunc a() (int, error) {\n\tos.Exit(0)\n\treturn 0, nil\n}\n",
+		// fmt of patch is re-aliased, so comments are printed with renamed copy of patch func
+		"package main\n\nimport \"os\"\n\nvar fmt = 0\n\nfunc a() (int, error) {\n\tos.Exit(fmt)\n\treturn 0, nil\n}\n",
+		// column of code on the line of function body is kept, though results are named
+		"package main\n\nimport \"os\"\n\nfunc a() error { os.Exit(0); return nil }\n",
+		// imports are added into import block
+		"package main\n\nimport (\n\t\"os\"\n\t\"strings\"\n)\n\nfunc a() (int, error) {\n\tos.Exit(0)\n" +
+			"\treturn 0, strings.ErrUnsupported\n}\n",
+	}
+	patchSet := newTestPatchSet(t, patch)
+	for _, content := range sources {
+		original, err := parser.ParseContent("source.go", []byte(content))
+		assert.NilError(t, err)
+		rewritten := rewriteTestSource(t, patchSet, content)
+		for _, comment := range []string{"// entry comment", "// trailing comment", "// exit comment"} {
+			assert.Assert(t, strings.Contains(rewritten, comment), comment)
+		}
+		meta, err := parser.ParseContent("source.go", []byte(rewritten))
+		assert.NilError(t, err)
+		// code after injected imports and patches keeps positions of original source
+		assert.DeepEqual(t, exitCallPosition(meta), exitCallPosition(original))
+		// line directives must stay at column 1 after gofmt, or they are ignored by compiler
+		formatted, err := format.Source([]byte(rewritten))
+		assert.NilError(t, err)
+		for _, line := range strings.Split(string(formatted), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), lineDirectivePrefix) {
+				assert.Assert(t, strings.HasPrefix(line, lineDirectivePrefix), line)
+			}
+		}
+	}
+}
+
+func TestRewriteSourceFileErrorPosition(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "source.go")
+	const content = "package main\n\nfunc a(k int) (int, error) { return k + \"x\", nil }\n\n" +
+		"func b() error {\n\treturn 1\n}\n"
+	assert.NilError(t, os.WriteFile(filename, []byte(content), 0644))
+	checker := parser.NewPackageLoader()
+	positions := func(content []byte) []string {
+		typeErrs, err := checker.CheckFile(filename, content)
+		assert.NilError(t, err)
+		var positions []string
+		for _, typeErr := range typeErrs {
+			positions = append(positions, typeErr.Fset.Position(typeErr.Pos).String())
+		}
+		return positions
+	}
+	want := positions([]byte(content))
+	assert.DeepEqual(t, want, []string{filename + ":3:37", filename + ":6:9"})
+	source, err := parser.ParseContent(filename, []byte(content))
+	assert.NilError(t, err)
+	opts := Options{PatchSet: newTestPatchSet(t, testPatchContent)}
+	assert.NilError(t, RewriteSourceFile(&source, opts))
+	// unnamed results are named on the line of error, but errors are reported at original positions
+	assert.Assert(t, strings.Contains(string(source.Content), "(instrumentResult0 int, instrumentResult1 error)"))
+	assert.DeepEqual(t, positions(source.Content), want)
+	// and so are errors of source instrumented again
+	rewritten, err := parser.ParseContent(filename, source.Content)
+	assert.NilError(t, err)
+	assert.NilError(t, RewriteSourceFile(&rewritten, opts))
+	assert.Equal(t, string(rewritten.Content), string(source.Content))
+}
+
+// exitCallPosition position of os.Exit call
+func exitCallPosition(meta parser.FileMeta) token.Position {
+	var pos token.Position
+	ast.Inspect(meta.ASTFile, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok && sel.Sel.Name == "Exit" {
+			pos = meta.FSet.Position(sel.Pos())
+			pos.Offset = 0
+		}
+		return true
+	})
+	return pos
+}
+
+func TestQualifiedFuncName(t *testing.T) {
+	tests := []struct {
+		decl       string
+		name       string
+		typeParams string
+	}{
+		{decl: "func Foo() {}", name: "Foo", typeParams: "Foo"},
+		{decl: "func Keys[K comparable, V any](m map[K]V) {}", name: "Keys", typeParams: "Keys[K,V]"},
+		{decl: "func (r Ring) Len() {}", name: "(Ring).Len", typeParams: "(Ring).Len"},
+		{decl: "func (r *Ring) Len() {}", name: "(*Ring).Len", typeParams: "(*Ring).Len"},
+		{decl: "func (r Ring[T]) Len() {}", name: "(Ring).Len", typeParams: "(Ring[T]).Len"},
+		{decl: "func (r *Ring[T]) Len() {}", name: "(*Ring).Len", typeParams: "(*Ring[T]).Len"},
+		{decl: "func (m Map[K, V]) Get() {}", name: "(Map).Get", typeParams: "(Map[K,V]).Get"},
+		{decl: "func (m *Map[K, _]) Get() {}", name: "(*Map).Get", typeParams: "(*Map[K,_]).Get"},
+		{decl: "func (r (Ring)) Len() {}", name: "(Ring).Len", typeParams: "(Ring).Len"},
+		{decl: "func (r *(Ring[T])) Len() {}", name: "(*Ring).Len", typeParams: "(*Ring[T]).Len"},
+		{decl: "func (r (*Map[K, V])) Get() {}", name: "(*Map).Get", typeParams: "(*Map[K,V]).Get"},
+	}
+	for _, tt := range tests {
+		meta, err := parser.ParseContent("source.go", []byte("package main\n\n"+tt.decl+"\n"))
+		assert.NilError(t, err)
+		decl := meta.ASTFile.Decls[0].(*ast.FuncDecl)
+		name, err := qualifiedFuncName(decl, false)
+		assert.NilError(t, err)
+		assert.Equal(t, name, tt.name)
+		name, err = qualifiedFuncName(decl, true)
+		assert.NilError(t, err)
+		assert.Equal(t, name, tt.typeParams)
+	}
+}
+
+func TestReceiverName(t *testing.T) {
+	ring := ast.NewIdent("Ring")
+	tests := []struct {
+		expr ast.Expr
+		err  string
+	}{
+		{expr: &ast.StarExpr{X: &ast.StarExpr{X: ring}}, err: "unknown recv type: **ast.StarExpr"},
+		{expr: &ast.SelectorExpr{X: ast.NewIdent("pkg"), Sel: ring}, err: "unknown recv type: *ast.SelectorExpr"},
+		{expr: &ast.IndexExpr{X: ring, Index: &ast.ArrayType{Elt: ast.NewIdent("int")}},
+			err: "unknown type param of recv Ring: *ast.ArrayType"},
+	}
+	for _, tt := range tests {
+		_, err := receiverName(tt.expr, true)
+		assert.Error(t, err, tt.err)
+	}
+	// type params are not checked if they are not included
+	name, err := receiverName(tests[2].expr, false)
+	assert.NilError(t, err)
+	assert.Equal(t, name, "Ring")
+}
+
+func TestRewriteSourceFileSpanNameTemplate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/svc\n"), 0644))
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "api"), 0755))
+	filename := filepath.Join(dir, "api", "source.go")
+	const content = "package api\n\ntype T struct{}\n\nfunc A() {}\n\nfunc (*T) B() {\n\tgo func() {}()\n}\n\nfunc (T) C() {}\n"
+	tests := []struct {
+		template  string
+		spanNames []string
+	}{
+		{template: "", spanNames: []string{"source.go-api.A", "source.go-api.(*T).B", "source.go-api.(*T).B.func1",
+			"source.go-api.(T).C"}},
+		{template: DefaultSpanNameTemplate, spanNames: []string{"source.go-api.A", "source.go-api.(*T).B",
+			"source.go-api.(*T).B.func1", "source.go-api.(T).C"}},
+		{template: "{{.ImportPath}}.{{if .Receiver}}{{.Receiver}}.{{end}}{{.Func}}", spanNames: []string{
+			"example.com/svc/api.A", "example.com/svc/api.T.B", "example.com/svc/api.T.B.func1",
+			"example.com/svc/api.T.C"}},
+		{template: "{{.File}}:{{.Line}} {{.Func}} {{.IsPointerRecv}}", spanNames: []string{"source.go:5 A false",
+			"source.go:7 B true", "source.go:8 B.func1 true", "source.go:11 C false"}},
+	}
+	for _, tt := range tests {
+		opts := Options{PatchSet: newTestPatchSet(t, testPatchContent), FuncLit: true}
+		if tt.template != "" {
+			tmpl, err := ParseSpanNameTemplate(tt.template)
+			assert.NilError(t, err)
+			opts.SpanNameTemplate = tmpl
+		}
+		source, err := parser.ParseContent(filename, []byte(content))
+		assert.NilError(t, err)
+		result, err := RewriteSourceFileWithResult(&source, opts)
+		assert.NilError(t, err)
+		var spanNames []string
+		for _, fn := range result.Funcs {
+			spanNames = append(spanNames, fn.SpanName)
+			assert.Assert(t, strings.Contains(string(source.Content), strconv.Quote(fn.SpanName)), fn.SpanName)
+		}
+		assert.DeepEqual(t, spanNames, tt.spanNames)
+		// lines of functions are kept by line directives, so span names are stable
+		rewritten, err := parser.ParseContent(filename, source.Content)
+		assert.NilError(t, err)
+		assert.NilError(t, RewriteSourceFile(&rewritten, opts))
+		assert.Equal(t, string(rewritten.Content), string(source.Content))
+	}
+	_, err := ParseSpanNameTemplate("{{.Unknown}}")
+	assert.ErrorContains(t, err, "can't evaluate field Unknown")
+	_, err = ParseSpanNameTemplate("{{.Func")
+	assert.ErrorContains(t, err, "parse span name template failed")
+}
+
+func TestRewriteSourceFileSpanNameTypeCheck(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/svc\n"), 0644))
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "api"), 0755))
+	const content = "package api\n\ntype Map struct{}\n\nfunc (*Map) Get() {}\n"
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "api", "source.go"), []byte(content), 0644))
+	tmpl, err := ParseSpanNameTemplate("{{.ImportPath}}.{{.Receiver}}.{{.Func}}")
+	assert.NilError(t, err)
+	opts := Options{PatchSet: newTestPatchSet(t, testPatchContent), SpanNameTemplate: tmpl}
+	metas, err := parser.NewPackageLoader().LoadDir(filepath.Join(dir, "api"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(metas), 1)
+	// packages checked with local import path are resolved by go.mod too
+	local := metas[0]
+	local.Pkg = types.NewPackage(".", "api")
+	for _, source := range []parser.FileMeta{metas[0], local} {
+		result, err := RewriteSourceFileWithResult(&source, opts)
+		assert.NilError(t, err)
+		assert.Equal(t, len(result.Funcs), 1)
+		assert.Equal(t, result.Funcs[0].SpanName, "example.com/svc/api.Map.Get")
+	}
+}
+
+func TestRewriteSourceFileLazyArgs(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, args func() []interface{}) {
+	fmt.Println(spanName, args())
+}
+
+func Exit(spanName string, _ gonativectx.Context, _ error, results func() []interface{}) {
+	fmt.Println(spanName, results())
+}
+`
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "source.go")
+	const content = "package main\n\nfunc Handle(id int, _ string) (string, error) {\n\treturn \"\", nil\n}\n"
+	assert.NilError(t, os.WriteFile(filename, []byte(content), 0644))
+	source, err := parser.ParseContent(filename, []byte(content))
+	assert.NilError(t, err)
+	opts := Options{PatchSet: newTestPatchSet(t, patchContent), Verify: true,
+		TypeChecker: parser.NewPackageLoader().CheckFile}
+	assert.NilError(t, RewriteSourceFile(&source, opts))
+	rewritten := string(source.Content)
+	// args and results are boxed only when closures are called
+	assert.Equal(t, strings.Count(rewritten, ":= func() []interface {"), 2)
+	assert.Assert(t, strings.Contains(rewritten, "}{id}"))
+	assert.Assert(t, strings.Contains(rewritten, "}{instrumentResult0, instrumentResult1}"))
+}
+
+func TestRewriteSourceFileFuncDesc(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, fn *struct {
+	Func       string
+	File       string
+	Line       int
+	ParamNames []string
+	ParamTypes []string
+}, args ...interface{}) {
+	for i, name := range fn.ParamNames {
+		fmt.Println(spanName, fn.Func, fn.File, fn.Line, name, fn.ParamTypes[i], args[i])
+	}
+}
+
+func Exit(spanName string, _ gonativectx.Context, _ error, _ ...interface{}) {
+	fmt.Println(spanName)
+}
+`
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "source.go")
+	const content = "package main\n\nimport \"context\"\n\ntype T struct{}\n\n" +
+		"func (*T) Handle(ctx context.Context, id int, _ string, opts ...int) {}\n\nfunc init() {}\n"
+	assert.NilError(t, os.WriteFile(filename, []byte(content), 0644))
+	source, err := parser.ParseContent(filename, []byte(content))
+	assert.NilError(t, err)
+	opts := Options{PatchSet: newTestPatchSet(t, patchContent), Verify: true,
+		TypeChecker: parser.NewPackageLoader().CheckFile}
+	assert.NilError(t, RewriteSourceFile(&source, opts))
+	rewritten := string(source.Content)
+	// descriptors are generated once per function, and shared by patches
+	for _, desc := range []string{`{Func: "(*T).Handle", File: "source.go", Line: 7, ParamNames: []string{"ctx", "id", ` +
+		`"opts"}, ParamTypes: []string{"context.Context", "int", "...int"}}`,
+		`{Func: "init", File: "source.go", Line: 9}`} {
+		assert.Equal(t, strings.Count(rewritten, desc), 1, desc)
+	}
+	assert.Equal(t, strings.Count(rewritten, markerBeginPrefix+descMarkerName), 1)
+	// descriptors are formatted by gofmt
+	formatted, err := format.Source(source.Content)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasSuffix(string(formatted),
+		rewritten[strings.Index(rewritten, markerBeginPrefix+descMarkerName):]))
+	// descriptors are replaced when instrumenting again, and removed by strip
+	again, err := parser.ParseContent(filename, source.Content)
+	assert.NilError(t, err)
+	assert.NilError(t, RewriteSourceFile(&again, opts))
+	assert.Equal(t, string(again.Content), rewritten)
+	stripped, err := parser.ParseContent(filename, source.Content)
+	assert.NilError(t, err)
+	assert.NilError(t, StripInstrumentation(&stripped))
+	assert.Equal(t, string(stripped.Content), content)
+}
+
+func TestRewriteSourceFilePanic(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func OnPanic(spanName string, _ gonativectx.Context, recovered interface{}, stack []byte) {
+	fmt.Println(spanName, "panic:", recovered, len(stack) > 0)
+}
+
+func OnPanicIgnored(spanName string, _ gonativectx.Context, _ interface{}, _ []byte) {
+	fmt.Println(spanName, "panic ignored")
+}
+`
+	const content = `package main
+
+import "fmt"
+
+func boom(n int) int {
+	if n > 0 {
+		panic(fmt.Sprint("boom ", n))
+	}
+	return n
+}
+
+func main() {
+	defer func() {
+		fmt.Println("recovered:", recover())
+	}()
+	fmt.Println(boom(0))
+	boom(1)
+}
+`
+	// panic wrappers are deferred in order of patches, recovered panic is re-raised to source function,
+	// and runtime/debug is imported only for patch reading stack
+	const want = `package main
+
+//instrument:begin import
+import gonativedebug "runtime/debug"
+//instrument:end import
+//line main.go:2:1
+
+import "fmt"
+
+func boom(n int) int {
+	//instrument:begin OnPanic
+	defer func() {
+		if recoveredpatchb91b8f08 := recover(); recoveredpatchb91b8f08 != nil {
+			spanNamepatchb91b8f08 := "main.go-main.boom"
+			stackpatchb91b8f08 := gonativedebug.Stack()
+			fmt.Println(spanNamepatchb91b8f08, "panic:", recoveredpatchb91b8f08, len(stackpatchb91b8f08) > 0)
+			panic(recoveredpatchb91b8f08)
+		}
+	}()
+	//instrument:end OnPanic
+//line main.go:5:23
+
+	//instrument:begin OnPanicIgnored
+	defer func() {
+		if instrumentRecovered := recover(); instrumentRecovered != nil {
+			spanNamepatch7a49d50a := "main.go-main.boom"
+			fmt.Println(spanNamepatch7a49d50a, "panic ignored")
+			panic(instrumentRecovered)
+		}
+	}()
+	//instrument:end OnPanicIgnored
+//line main.go:5:23
+
+	if n > 0 {
+		panic(fmt.Sprint("boom ", n))
+	}
+	return n
+}
+
+func main() {
+	//instrument:begin OnPanic
+	defer func() {
+		if recoveredpatchb91b8f08 := recover(); recoveredpatchb91b8f08 != nil {
+			spanNamepatchb91b8f08 := "main.go-main.main"
+			stackpatchb91b8f08 := gonativedebug.Stack()
+			fmt.Println(spanNamepatchb91b8f08, "panic:", recoveredpatchb91b8f08, len(stackpatchb91b8f08) > 0)
+			panic(recoveredpatchb91b8f08)
+		}
+	}()
+	//instrument:end OnPanic
+//line main.go:12:14
+
+	//instrument:begin OnPanicIgnored
+	defer func() {
+		if instrumentRecovered := recover(); instrumentRecovered != nil {
+			spanNamepatch7a49d50a := "main.go-main.main"
+			fmt.Println(spanNamepatch7a49d50a, "panic ignored")
+			panic(instrumentRecovered)
+		}
+	}()
+	//instrument:end OnPanicIgnored
+//line main.go:12:14
+
+	defer func() {
+		fmt.Println("recovered:", recover())
+	}()
+	fmt.Println(boom(0))
+	boom(1)
+}
+`
+	rewritten, out := runTestSource(t, Options{PatchSet: newTestPatchSet(t, patchContent)}, content)
+	assert.Equal(t, rewritten, want)
+	assert.Equal(t, out, "0\nmain.go-main.boom panic ignored\nmain.go-main.boom panic: boom 1 true\nrecovered: boom 1\n")
+}
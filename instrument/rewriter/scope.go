@@ -0,0 +1,177 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"github.com/jattle/go-instrumentation/internal/instrument/astvisitor"
+)
+
+// fileScope names declared in package block, which can not be used by imports of source file,
+// imported package names are not included
+type fileScope map[string]token.Position
+
+// newFileScope collect names of top level decls of source package, decls in marked blocks are ignored.
+// package scope is used if source file is loaded with types, otherwise top level decls of source file
+// and other go files of the same package in its dir are parsed.
+func newFileScope(source parser.FileMeta, blocks []markedBlock) fileScope {
+	scope := make(fileScope)
+	if source.Pkg != nil {
+		for _, name := range source.Pkg.Scope().Names() {
+			scope[name] = source.FSet.Position(source.Pkg.Scope().Lookup(name).Pos())
+		}
+		return scope
+	}
+	addFileDecls(scope, source.FSet, source.ASTFile, func(ident *ast.Ident) bool {
+		return inBlocks(blocks, source.FSet.Position(ident.Pos()).Offset)
+	})
+	// other files of the same package, files can not be read are ignored
+	dir := filepath.Dir(source.FileName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return scope
+	}
+	fset := token.NewFileSet()
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || !parser.IsSourceFile(filename) || filepath.Base(filename) == filepath.Base(source.FileName) {
+			continue
+		}
+		file, err := goparser.ParseFile(fset, filename, nil, goparser.SkipObjectResolution)
+		if err != nil || file.Name.Name != source.ASTFile.Name.Name {
+			continue
+		}
+		addFileDecls(scope, fset, file, nil)
+	}
+	return scope
+}
+
+// addFileDecls add names of top level decls of file into scope, identifiers are ignored if skip returns true
+func addFileDecls(scope fileScope, fset *token.FileSet, file *ast.File, skip func(*ast.Ident) bool) {
+	add := func(ident *ast.Ident) {
+		if ident == nil || isBlankIdent(ident.Name) || (skip != nil && skip(ident)) {
+			return
+		}
+		if _, ok := scope[ident.Name]; !ok {
+			scope[ident.Name] = fset.Position(ident.Pos())
+		}
+	}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			// methods and init funcs are not declared in package block
+			if d.Recv == nil && d.Name.Name != "init" {
+				add(d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						add(name)
+					}
+				case *ast.TypeSpec:
+					add(s.Name)
+				}
+			}
+		}
+	}
+}
+
+// funcScope identifiers of source function, used to detect collisions with injected code
+type funcScope struct {
+	// idents names of all identifiers in function, vars and labels injected at the beginning of function body
+	// must not use them, otherwise they may be redeclared, or shadow names referenced by source code
+	idents map[string]struct{}
+	// params names declared by receiver, type params, params and results, visible to injected code
+	params map[string]*ast.Ident
+	file   fileScope
+}
+
+// newFuncScope analyze scope of source function, identifiers in marked blocks are ignored
+func newFuncScope(source parser.FileMeta, fn sourceFunc, blocks []markedBlock, file fileScope) *funcScope {
+	inBlock := func(ident *ast.Ident) bool {
+		return inBlocks(blocks, source.FSet.Position(ident.Pos()).Offset)
+	}
+	scope := &funcScope{
+		idents: astvisitor.CollectIdentNames(fn.node, inBlock),
+		params: make(map[string]*ast.Ident),
+		file:   file,
+	}
+	if fn.outer != nil {
+		// names declared in enclosing function may be visible to function literal, all of them are treated as visible
+		ast.Inspect(fn.outer, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok && ident.Obj != nil && ident.Obj.Kind != ast.Lbl &&
+				!isBlankIdent(ident.Name) && !inBlock(ident) {
+				if _, ok := scope.params[ident.Name]; !ok {
+					scope.params[ident.Name] = ident
+				}
+			}
+			return true
+		})
+	}
+	fieldLists := []*ast.FieldList{fn.recv, fn.funcType.TypeParams, fn.funcType.Params, fn.funcType.Results}
+	for _, fields := range fieldLists {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				if !isBlankIdent(name.Name) {
+					scope.params[name.Name] = name
+				}
+			}
+		}
+	}
+	return scope
+}
+
+// checkPackageRefs check packages referenced by injected code of patch func are not shadowed by source names,
+// packages renamed by aliases are checked by their new names
+func (s *funcScope) checkPackageRefs(source parser.FileMeta, patchFunc *ast.FuncDecl, refs []string,
+	aliases map[string]string) error {
+	for _, pkg := range refs {
+		if alias, ok := aliases[pkg]; ok {
+			pkg = alias
+		}
+		if ident, ok := s.params[pkg]; ok {
+			return fmt.Errorf("%s: package %s referenced by patch %s is shadowed by %s",
+				source.FSet.Position(ident.Pos()), pkg, patchFunc.Name.Name, ident.Name)
+		}
+		if pos, ok := s.file[pkg]; ok {
+			return fmt.Errorf("%s: package %s referenced by patch %s conflicts with %s declared in package block",
+				pos, pkg, patchFunc.Name.Name, pkg)
+		}
+	}
+	return nil
+}
+
+// packageRefs names of packages referenced by stmts, sorted, package names are unresolved identifiers of selector
+// expressions, eg: fmt of fmt.Println, only names of imports are returned.
+func packageRefs(stmts []ast.Stmt, imports map[string]struct{}) []string {
+	refs := make(map[string]struct{})
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(node ast.Node) bool {
+			if sel, ok := node.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+					if _, ok := imports[x.Name]; ok {
+						refs[x.Name] = struct{}{}
+					}
+				}
+			}
+			return true
+		})
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,225 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	iparser "github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+const (
+	contextPkgPath  = "context"
+	contextTypeName = "Context"
+	nativeCtxPkg    = "gonativectx"
+)
+
+// CtxAccessor how to get context.Context from source function param of specified type,
+// and how to propagate new context back to this param
+type CtxAccessor struct {
+	// Get expr appended to param name to get context, eg: .Context()
+	Get string
+	// Set optional, expr appended to param name to create new param value with new context,
+	// %s is replaced with new context, eg: .WithContext(%s)
+	Set string
+}
+
+// DefaultCtxAccessors accessors of params which carry context.Context, key is param type string formatted
+// by types.TypeString, eg: *net/http.Request, *github.com/gin-gonic/gin.Context, a new map is returned every time,
+// so it can be extended by caller.
+func DefaultCtxAccessors() map[string]CtxAccessor {
+	return map[string]CtxAccessor{
+		"*net/http.Request": {Get: ".Context()", Set: ".WithContext(%s)"},
+	}
+}
+
+// sourceCtx context param of source function
+type sourceCtx struct {
+	// name of param carrying context, empty if source function has no context param
+	name string
+	// identical type is context.Context, so param can be used and assigned directly
+	identical bool
+	// nilable param is a pointer carrying context, it is checked before getting context from it,
+	// eg: handler called with nil *http.Request
+	nilable  bool
+	accessor CtxAccessor
+}
+
+func (c sourceCtx) exists() bool {
+	return c.name != "" && !isBlankIdent(c.name)
+}
+
+// valueExpr expr of context.Context value
+func (c sourceCtx) valueExpr() ast.Expr {
+	if c.identical {
+		return ast.NewIdent(c.name)
+	}
+	if c.accessor.Get != "" {
+		if expr, err := parser.ParseExpr(c.name + c.accessor.Get); err == nil {
+			return expr
+		}
+	}
+	// param implements context.Context, convert it to context.Context
+	return &ast.CallExpr{
+		Fun:  &ast.SelectorExpr{X: ast.NewIdent(nativeCtxPkg), Sel: ast.NewIdent(contextTypeName)},
+		Args: []ast.Expr{ast.NewIdent(c.name)},
+	}
+}
+
+// notNilExpr expr checking param carrying context is not nil
+func (c sourceCtx) notNilExpr() ast.Expr {
+	return &ast.BinaryExpr{X: ast.NewIdent(c.name), Op: token.NEQ, Y: ast.NewIdent("nil")}
+}
+
+// guard wrap stmt reading param with nil check if param is nilable
+func (c sourceCtx) guard(stmt ast.Stmt) ast.Stmt {
+	if stmt == nil || !c.nilable {
+		return stmt
+	}
+	return &ast.IfStmt{Cond: c.notNilExpr(), Body: &ast.BlockStmt{List: []ast.Stmt{stmt}}}
+}
+
+// propagateStmt create stmt propagating new context back to source param, nil if not supported
+func (c sourceCtx) propagateStmt(newCtx string) ast.Stmt {
+	var rhs ast.Expr = ast.NewIdent(newCtx)
+	if !c.identical {
+		if c.accessor.Set == "" {
+			return nil
+		}
+		expr, err := parser.ParseExpr(c.name + fmt.Sprintf(c.accessor.Set, newCtx))
+		if err != nil {
+			return nil
+		}
+		rhs = expr
+	}
+	return &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent(c.name)},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{rhs},
+	}
+}
+
+// resolveSourceCtx find context param of source function, param whose type is identical to context.Context
+// is preferred, then params matched by accessors, finally params implement context.Context.
+// type information is used if source file is loaded with types, otherwise types are resolved by file imports.
+func resolveSourceCtx(srcMeta iparser.FileMeta, funcType *ast.FuncType, accessors map[string]CtxAccessor) sourceCtx {
+	if funcType.Params == nil {
+		return sourceCtx{}
+	}
+	var accessorCtx, implementsCtx sourceCtx
+	for _, field := range funcType.Params.List {
+		// func abc(context.Context,string) is valid
+		if len(field.Names) == 0 || isBlankIdent(field.Names[0].Name) {
+			continue
+		}
+		name := field.Names[0].Name
+		var (
+			typeName string
+			nilable  bool
+		)
+		if t := typeOf(srcMeta, field.Type); t != nil {
+			if isContextType(t) {
+				return sourceCtx{name: name, identical: true}
+			}
+			typeName = types.TypeString(t, nil)
+			_, nilable = t.Underlying().(*types.Pointer)
+			if implementsCtx.name == "" && implementsContext(t) {
+				implementsCtx = sourceCtx{name: name, nilable: nilable}
+			}
+		} else {
+			typeName = syntacticTypeName(srcMeta.ASTFile, field.Type)
+			if typeName == contextPkgPath+"."+contextTypeName {
+				return sourceCtx{name: name, identical: true}
+			}
+			_, nilable = field.Type.(*ast.StarExpr)
+		}
+		if accessor, ok := accessors[typeName]; ok && accessorCtx.name == "" {
+			accessorCtx = sourceCtx{name: name, nilable: nilable, accessor: accessor}
+		}
+	}
+	if accessorCtx.name != "" {
+		return accessorCtx
+	}
+	return implementsCtx
+}
+
+func typeOf(srcMeta iparser.FileMeta, expr ast.Expr) types.Type {
+	if srcMeta.TypesInfo == nil {
+		return nil
+	}
+	t := srcMeta.TypesInfo.TypeOf(expr)
+	if t == nil || t == types.Typ[types.Invalid] {
+		return nil
+	}
+	return t
+}
+
+// isContextType type is context.Context or alias of it
+func isContextType(t types.Type) bool {
+	named, ok := types.Unalias(t).(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == contextPkgPath && obj.Name() == contextTypeName
+}
+
+// implementsContext method set of type contains all methods of context.Context
+func implementsContext(t types.Type) bool {
+	methodSet := types.NewMethodSet(t)
+	for _, method := range []string{"Deadline", "Done", "Err", "Value"} {
+		if methodSet.Lookup(nil, method) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// syntacticTypeName resolve type name of param type expr by file imports, format is the same as types.TypeString,
+// eg: gocontext.Context => context.Context, *http.Request => *net/http.Request,
+// empty string returned if type can not be resolved
+func syntacticTypeName(file *ast.File, expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		if name := syntacticTypeName(file, t.X); name != "" {
+			return "*" + name
+		}
+	case *ast.SelectorExpr:
+		x, ok := t.X.(*ast.Ident)
+		if !ok {
+			return ""
+		}
+		if pkgPath := importPathOf(file, x.Name); pkgPath != "" {
+			return pkgPath + "." + t.Sel.Name
+		}
+	case *ast.Ident:
+		// dot import
+		if t.Name == contextTypeName && importPathOf(file, ".") == contextPkgPath {
+			return contextPkgPath + "." + contextTypeName
+		}
+	}
+	return ""
+}
+
+// importPathOf get import path of package name in file, package name is assumed to be the last element
+// of import path if import has no alias.
+func importPathOf(file *ast.File, pkgName string) string {
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := importPath[strings.LastIndex(importPath, "/")+1:]
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name == pkgName {
+			return importPath
+		}
+	}
+	return ""
+}
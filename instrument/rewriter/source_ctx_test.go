@@ -0,0 +1,131 @@
+package rewriter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"gotest.tools/assert"
+)
+
+const ctxSourceContent = `package main
+
+import (
+	gocontext "context"
+	"net/http"
+)
+
+type Ctx = gocontext.Context
+
+type MyCtx interface {
+	gocontext.Context
+	Foo()
+}
+
+func a(ctx gocontext.Context) {}
+
+func b(r *http.Request, ctx gocontext.Context) {}
+
+func c(r *http.Request) {}
+
+func d(ctx Ctx) {}
+
+func e(ctx MyCtx) {}
+
+func f(_ gocontext.Context, s string) {}
+`
+
+type ctxWant struct {
+	name      string
+	identical bool
+}
+
+func TestResolveSourceCtx(t *testing.T) {
+	syntacticWants := map[string]ctxWant{
+		"a": {name: "ctx", identical: true},
+		"b": {name: "ctx", identical: true},
+		"c": {name: "r"},
+		"d": {},
+		"e": {},
+		"f": {},
+	}
+	typedWants := map[string]ctxWant{
+		"a": {name: "ctx", identical: true},
+		"b": {name: "ctx", identical: true},
+		"c": {name: "r"},
+		"d": {name: "ctx", identical: true},
+		"e": {name: "ctx"},
+		"f": {},
+	}
+	meta, err := parser.ParseContent("main.go", []byte(ctxSourceContent))
+	assert.NilError(t, err)
+	checkSourceCtx(t, meta, syntacticWants)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "main.go")
+	assert.NilError(t, os.WriteFile(filename, []byte(ctxSourceContent), 0644))
+	metas, err := parser.NewPackageLoader().LoadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(metas), 1)
+	assert.Assert(t, metas[0].TypesInfo != nil)
+	checkSourceCtx(t, metas[0], typedWants)
+}
+
+func checkSourceCtx(t *testing.T, meta parser.FileMeta, wants map[string]ctxWant) {
+	for funcName, w := range wants {
+		funcs := filter.SelectFuncDecls(meta.ASTFile.Decls, getFuncByName(funcName))
+		assert.Equal(t, len(funcs), 1)
+		ctx := resolveSourceCtx(meta, funcs[0].Type, DefaultCtxAccessors())
+		assert.Equal(t, ctx.name, w.name, funcName)
+		assert.Equal(t, ctx.identical, w.identical, funcName)
+	}
+}
+
+func TestRewriteSourceFileNilCtxParam(t *testing.T) {
+	const patchContent = `package patch
+
+import (
+	gonativectx "context"
+	"fmt"
+)
+
+func Entry(spanName string, hasCtx bool, ctx gonativectx.Context, _ ...interface{}) {
+	fmt.Println(spanName, hasCtx, ctx.Value("k"))
+}
+
+func Exit(spanName string, ctx gonativectx.Context, _ error, _ ...interface{}) {
+	fmt.Println(spanName, ctx.Value("k"))
+}
+`
+	const content = `package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("handled", r == nil)
+}
+
+func main() {
+	handle(nil, nil)
+	r, _ := http.NewRequestWithContext(context.WithValue(context.Background(), "k", "v"), "GET", "/", nil)
+	handle(nil, r)
+}
+`
+	// context is not got from nil request, so handler is called as is
+	_, out := runTestSource(t, Options{PatchSet: newTestPatchSet(t, patchContent)}, content)
+	assert.Equal(t, out, `main.go-main.main false <nil>
+main.go-main.handle false <nil>
+handled true
+main.go-main.handle <nil>
+main.go-main.handle true v
+handled false
+main.go-main.handle v
+main.go-main.main <nil>
+`)
+}
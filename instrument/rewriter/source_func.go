@@ -0,0 +1,196 @@
+package rewriter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"path/filepath"
+
+	"github.com/jattle/go-instrumentation/instrument/config"
+	"github.com/jattle/go-instrumentation/instrument/filter"
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+// sourceFunc function of source file to instrument, function declaration or function literal
+type sourceFunc struct {
+	// name qualified function name, function literals are named by their enclosing function and index,
+	// eg: (*T).Foo, Foo.func1, Foo.func1.1, and init.func1 for package level literals
+	name     string
+	node     ast.Node
+	recv     *ast.FieldList
+	funcType *ast.FuncType
+	body     *ast.BlockStmt
+	// outer top level function declaration enclosing function literal, nil for function declarations
+	// and package level function literals
+	outer *ast.FuncDecl
+	// patches files of patch funcs applied to function, all patches are applied if nil
+	patches []string
+	// patchNames names of patch funcs applied to function by `//instrument:patches=` directive, all patch funcs
+	// of patches are applied if nil
+	patchNames []string
+}
+
+// collectSourceFuncs collect functions to instrument of source file, function literals are collected only if
+// FuncLit is enabled, literals in marked blocks are ignored since they are injected by rewriter.
+// function declarations not selected by filter or rules are returned as skipped.
+func collectSourceFuncs(source parser.FileMeta, blocks []markedBlock, opts Options) (funcs []sourceFunc,
+	skipped []FuncResult, err error) {
+	var initLits int
+	pkgPath, err := sourcePkgPath(source, opts.FuncRules)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, decl := range source.ASTFile.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if filter.HasExcludeDirective(d) {
+				skipped = append(skipped, skippedDecl(source, d, SkipReasonExcludeComment))
+				continue
+			}
+			if !opts.Filter(d) {
+				skipped = append(skipped, skippedDecl(source, d, SkipReasonFiltered))
+				continue
+			}
+			patches, ok := matchFuncRules(opts.FuncRules, config.FuncInfo{PkgPath: pkgPath, File: source.FileName,
+				Receiver: receiverTypeName(d.Recv), Name: d.Name.Name})
+			if !ok {
+				skipped = append(skipped, skippedDecl(source, d, SkipReasonNoRule))
+				continue
+			}
+			name, err := qualifiedFuncName(d, opts.TypeParams)
+			if err != nil {
+				skipped = append(skipped, skippedDecl(source, d, SkipReasonUnsupportedRecv))
+				continue
+			}
+			patchNames, _ := filter.PatchNamesDirective(d)
+			funcs = append(funcs, sourceFunc{name: name, node: d, recv: d.Recv, funcType: d.Type, body: d.Body,
+				patches: patches, patchNames: patchNames})
+			if opts.FuncLit && d.Body != nil {
+				var lits int
+				funcs = append(funcs, withPatches(collectFuncLits(source, blocks, d.Body, name, d, &lits), patches,
+					patchNames)...)
+			}
+		case *ast.GenDecl:
+			if !opts.FuncLit {
+				continue
+			}
+			if patches, ok := matchFuncRules(opts.FuncRules, config.FuncInfo{PkgPath: pkgPath, File: source.FileName,
+				Name: "init"}); ok {
+				funcs = append(funcs, withPatches(collectFuncLits(source, blocks, d, "init", nil, &initLits), patches,
+					nil)...)
+			}
+		}
+	}
+	return funcs, skipped, nil
+}
+
+// skippedDecl result of function declaration not instrumented, named by receiver type name since
+// skipped function may have receiver not supported by qualifiedFuncName
+func skippedDecl(source parser.FileMeta, d *ast.FuncDecl, reason string) FuncResult {
+	return FuncResult{Name: declName(d), Pos: source.FSet.Position(d.Pos()), SkipReason: reason}
+}
+
+// declName name of function declaration with receiver type name, eg: (*T).Foo
+func declName(d *ast.FuncDecl) string {
+	if recv := receiverTypeName(d.Recv); recv != "" {
+		return "(" + recv + ")." + d.Name.Name
+	}
+	return d.Name.Name
+}
+
+// sourcePkgPath import path of source package matched by rules, empty if there is no rule,
+// error is returned if rules match packages but import path can not be resolved
+func sourcePkgPath(source parser.FileMeta, rules *config.Config) (string, error) {
+	if rules == nil {
+		return "", nil
+	}
+	pkgPath := sourceImportPath(source)
+	if pkgPath == "" && rules.MatchPackages() {
+		return "", fmt.Errorf("import path of %s not resolved, packages of rules can not be matched",
+			source.FileName)
+	}
+	return pkgPath, nil
+}
+
+// sourceImportPath import path of source package, resolved by go.mod if source file is not loaded with types,
+// or path of types is not an import path, eg: "." of packages checked in module mode
+func sourceImportPath(source parser.FileMeta) string {
+	if source.Pkg != nil && source.Pkg.Path() != "" && !build.IsLocalImport(source.Pkg.Path()) {
+		return source.Pkg.Path()
+	}
+	return parser.PackagePath(filepath.Dir(source.FileName))
+}
+
+// matchFuncRules match function by rules, patches is nil if all patches are applied
+func matchFuncRules(rules *config.Config, fn config.FuncInfo) (patches []string, ok bool) {
+	if rules == nil {
+		return nil, true
+	}
+	return rules.Match(fn)
+}
+
+// withPatches function literals inherit patches of enclosing function
+func withPatches(funcs []sourceFunc, patches, patchNames []string) []sourceFunc {
+	for i := range funcs {
+		funcs[i].patches = patches
+		funcs[i].patchNames = patchNames
+	}
+	return funcs
+}
+
+// receiverTypeName type name of receiver without type params, eg: *Ring for func (r *Ring[T]) foo()
+func receiverTypeName(recv *ast.FieldList) string {
+	if recv == nil || len(recv.List) == 0 {
+		return ""
+	}
+	var prefix string
+	expr := recv.List[0].Type
+	for {
+		switch t := expr.(type) {
+		case *ast.ParenExpr:
+			expr = t.X
+			continue
+		case *ast.StarExpr:
+			prefix = "*"
+			expr = t.X
+			continue
+		case *ast.IndexExpr:
+			expr = t.X
+			continue
+		case *ast.IndexListExpr:
+			expr = t.X
+			continue
+		case *ast.Ident:
+			return prefix + t.Name
+		}
+		return ""
+	}
+}
+
+// collectFuncLits collect function literals in node, literals are numbered in source order like go compiler,
+// literals directly in enclosing function are named enclosing.funcN, nested ones are named enclosing.funcN.M
+func collectFuncLits(source parser.FileMeta, blocks []markedBlock, node ast.Node, enclosing string,
+	outer *ast.FuncDecl, index *int) []sourceFunc {
+	return collectFuncLitsWithFormat(source, blocks, node, enclosing+".func%d", outer, index)
+}
+
+func collectFuncLitsWithFormat(source parser.FileMeta, blocks []markedBlock, node ast.Node, nameFormat string,
+	outer *ast.FuncDecl, index *int) []sourceFunc {
+	var funcs []sourceFunc
+	ast.Inspect(node, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		if inBlocks(blocks, source.FSet.Position(lit.Pos()).Offset) {
+			return false
+		}
+		*index++
+		name := fmt.Sprintf(nameFormat, *index)
+		funcs = append(funcs, sourceFunc{name: name, node: lit, funcType: lit.Type, body: lit.Body, outer: outer})
+		var nested int
+		funcs = append(funcs, collectFuncLitsWithFormat(source, blocks, lit.Body, name+".%d", outer, &nested)...)
+		return false
+	})
+	return funcs
+}
@@ -0,0 +1,72 @@
+package rewriter
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// DefaultSpanNameTemplate span name template equivalent to default span names, eg: source.go-main.(*T).Foo
+const DefaultSpanNameTemplate = `{{.File}}-{{.Package}}.{{if .Receiver}}({{if .IsPointerRecv}}*{{end}}` +
+	`{{.Receiver}}).{{end}}{{.Func}}`
+
+// SpanNameData fields of span name template
+type SpanNameData struct {
+	// ImportPath import path of source package, resolved by go.mod if package is not type checked,
+	// empty if it can not be resolved
+	ImportPath string
+	// Package name of source package
+	Package string
+	// File base name of source file
+	File string
+	// Line line of function in source file
+	Line int
+	// Receiver receiver type name without *, empty for functions without receiver, eg: T for func (t *T) Foo()
+	Receiver string
+	// Func function name without receiver, function literals are named by enclosing function, eg: Foo, Foo.func1
+	Func string
+	// IsPointerRecv receiver is a pointer
+	IsPointerRecv bool
+}
+
+// ParseSpanNameTemplate parse span name template, eg: {{.ImportPath}}.{{.Receiver}}.{{.Func}},
+// template is executed with sample data, so unknown fields are reported before rewriting
+func ParseSpanNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("span_name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse span name template failed: %w", err)
+	}
+	sample := SpanNameData{ImportPath: "example.com/pkg", Package: "pkg", File: "source.go", Line: 1,
+		Receiver: "T", Func: "Foo", IsPointerRecv: true}
+	if err = tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, fmt.Errorf("execute span name template failed: %w", err)
+	}
+	return tmpl, nil
+}
+
+// genSpanName span name of function by template, default span name is filename - pkg.function if tmpl is nil
+func genSpanName(tmpl *template.Template, data SpanNameData, funcName string) (string, error) {
+	if tmpl == nil {
+		return fmt.Sprintf("%s-%s.%s", data.File, data.Package, funcName), nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("execute span name template failed: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// spanNameData template data of source function, receiver is split from qualified name, eg: (*T).Foo.func1
+func spanNameData(importPath, pkgName, filename string, line int, funcName string) SpanNameData {
+	data := SpanNameData{ImportPath: importPath, Package: pkgName, File: path.Base(filename), Line: line,
+		Func: funcName}
+	if strings.HasPrefix(funcName, "(") {
+		if i := strings.Index(funcName, ")."); i > 0 {
+			data.Receiver, data.Func = funcName[1:i], funcName[i+2:]
+			data.Receiver, data.IsPointerRecv = strings.CutPrefix(data.Receiver, "*")
+		}
+	}
+	return data
+}
@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"go/ast"
+	"go/token"
+	"regexp"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+var (
+	resultNameExpr      = regexp.MustCompile("^" + resultNamePrefix + `\d+$`)
+	blankResultNameExpr = regexp.MustCompile("^" + blankResultNamePrefix + `\d+$`)
+	bareResultNameExpr  = regexp.MustCompile("^" + bareResultNamePrefix + `\d+$`)
+)
+
+// StripInstrumentation remove code injected by rewriter from source file, including marked code blocks,
+// added imports and result names of source functions, source content is restored to the original one.
+func StripInstrumentation(source *parser.FileMeta) error {
+	blocks, err := findMarkedBlocks(*source)
+	if err != nil {
+		return err
+	}
+	edits := make([]Edit, 0, len(blocks))
+	for _, block := range blocks {
+		edits = append(edits, delBlockEdit(block))
+	}
+	// results of function literals may be named if they are instrumented
+	ast.Inspect(source.ASTFile, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.FuncDecl:
+			edits = append(edits, restoreSourceResults(*source, n.Type)...)
+		case *ast.FuncLit:
+			edits = append(edits, restoreSourceResults(*source, n.Type)...)
+		}
+		return true
+	})
+	if len(edits) == 0 {
+		return nil
+	}
+	rewriter := &FileRewriter{Content: source.Content, Edits: edits}
+	source.Content, err = rewriter.Rewrite()
+	return err
+}
+
+// restoreSourceResults generate edits reverting result names added by nameSourceResults
+func restoreSourceResults(srcMeta parser.FileMeta, funcType *ast.FuncType) (edits []Edit) {
+	fields := funcType.Results
+	if fields == nil {
+		return
+	}
+	offset := func(pos interface{ Pos() token.Pos }) int {
+		return srcMeta.FSet.Position(pos.Pos()).Offset
+	}
+	for _, field := range fields.List {
+		if len(field.Names) != 1 {
+			continue
+		}
+		ident := field.Names[0]
+		switch {
+		case resultNameExpr.MatchString(ident.Name):
+			// (instrumentResult0 int) => (int)
+			edits = append(edits, Edit{OpType: EditTypeDel, BeginPos: offset(ident), EndPos: offset(field.Type) - 1})
+		case blankResultNameExpr.MatchString(ident.Name):
+			// (instrumentBlankResult0 int) => (_ int)
+			edits = append(edits, Edit{
+				OpType: EditTypeReplace, BeginPos: offset(ident), EndPos: offset(ident) + len(ident.Name) - 1,
+				Content: []byte("_"),
+			})
+		case bareResultNameExpr.MatchString(ident.Name) && len(fields.List) == 1:
+			// (instrumentBareResult0 error) => error
+			begin := srcMeta.FSet.Position(fields.Opening).Offset
+			closing := srcMeta.FSet.Position(fields.Closing).Offset
+			edits = append(edits,
+				Edit{OpType: EditTypeDel, BeginPos: begin, EndPos: offset(field.Type) - 1},
+				Edit{OpType: EditTypeDel, BeginPos: closing, EndPos: closing})
+		}
+	}
+	return
+}
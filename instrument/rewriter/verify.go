@@ -0,0 +1,132 @@
+package rewriter
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"path/filepath"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+// TypeChecker type check package of file with content replaced, type errors of package are returned,
+// eg: parser.PackageLoader.CheckFile
+type TypeChecker func(filename string, content []byte) ([]types.Error, error)
+
+// VerifyError rewritten source fails to parse or type check
+type VerifyError struct {
+	// Pos position of the first error in rewritten content
+	Pos token.Position
+	// Func source function containing the error, empty if error is out of functions
+	Func string
+	// Patch name of patch func whose injected code causes the error, import if it is caused by injected imports,
+	// func if it is caused by injected func descriptors, empty if error is out of injected code
+	Patch string
+	Err   error
+}
+
+func (e *VerifyError) Error() string {
+	switch {
+	case e.Patch == importMarkerName:
+		return fmt.Sprintf("%s: injected imports fail to compile: %v", e.Pos, e.Err)
+	case e.Patch == descMarkerName:
+		return fmt.Sprintf("%s: injected func descriptors fail to compile: %v", e.Pos, e.Err)
+	case e.Patch != "":
+		return fmt.Sprintf("%s: injected code of patch %s in %s fails to compile: %v", e.Pos, e.Patch, e.Func, e.Err)
+	}
+	return fmt.Sprintf("%s: instrumented source fails to compile: %v", e.Pos, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// verifyRewrite parse rewritten content, and type check it if checker is not nil, type errors out of injected code
+// which are also reported for original content are ignored, so broken source packages are not blamed on patches.
+func verifyRewrite(filename string, original, rewritten []byte, checker TypeChecker) error {
+	meta, err := parser.ParseContent(filename, rewritten)
+	if err != nil {
+		var list scanner.ErrorList
+		if errors.As(err, &list) && len(list) > 0 {
+			return newVerifyError(meta, list[0].Pos, errors.New(list[0].Msg))
+		}
+		return err
+	}
+	if checker == nil {
+		return nil
+	}
+	typeErrs, err := checker(filename, rewritten)
+	if err != nil {
+		return fmt.Errorf("type check %s failed: %w", filename, err)
+	}
+	var baseline map[string]int
+	for _, typeErr := range typeErrs {
+		// positions of rewritten content, not adjusted by line directives
+		pos := typeErr.Fset.PositionFor(typeErr.Pos, false)
+		if filepath.Clean(pos.Filename) != filepath.Clean(filename) {
+			continue
+		}
+		verifyErr := newVerifyError(meta, pos, errors.New(typeErr.Msg))
+		if verifyErr.Patch == "" {
+			if baseline == nil {
+				if baseline, err = typeErrorsOf(filename, original, checker); err != nil {
+					return err
+				}
+			}
+			if baseline[typeErr.Msg] > 0 {
+				baseline[typeErr.Msg]--
+				continue
+			}
+		}
+		return verifyErr
+	}
+	return nil
+}
+
+// typeErrorsOf counts of type error messages of file
+func typeErrorsOf(filename string, content []byte, checker TypeChecker) (map[string]int, error) {
+	typeErrs, err := checker(filename, content)
+	if err != nil {
+		return nil, fmt.Errorf("type check %s failed: %w", filename, err)
+	}
+	counts := make(map[string]int)
+	for _, typeErr := range typeErrs {
+		if filepath.Clean(typeErr.Fset.PositionFor(typeErr.Pos, false).Filename) == filepath.Clean(filename) {
+			counts[typeErr.Msg]++
+		}
+	}
+	return counts, nil
+}
+
+// newVerifyError locate patch and source function of error position in rewritten source,
+// ast of meta may be partial if rewritten source fails to parse
+func newVerifyError(meta parser.FileMeta, pos token.Position, err error) *VerifyError {
+	verifyErr := &VerifyError{Pos: pos, Err: err}
+	if meta.ASTFile == nil {
+		return verifyErr
+	}
+	// syntax errors are reported with positions adjusted by line directives
+	if file := meta.FSet.File(meta.ASTFile.Pos()); file != nil && pos.Offset <= file.Size() {
+		verifyErr.Pos = file.PositionFor(file.Pos(pos.Offset), false)
+	}
+	if blocks, e := findMarkedBlocks(meta); e == nil {
+		for _, block := range blocks {
+			if pos.Offset >= block.Begin && pos.Offset < block.End {
+				verifyErr.Patch = block.Name
+				break
+			}
+		}
+	}
+	for _, decl := range meta.ASTFile.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || pos.Offset < meta.FSet.Position(d.Pos()).Offset || pos.Offset >= meta.FSet.Position(d.End()).Offset {
+			continue
+		}
+		verifyErr.Func = declName(d)
+		break
+	}
+	return verifyErr
+}
@@ -0,0 +1,78 @@
+package rewriter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+	"gotest.tools/assert"
+)
+
+func TestVerifyRewrite(t *testing.T) {
+	dir := t.TempDir()
+	// type error out of injected code exists before instrumentation, it should not be blamed on patches
+	source := "package main\n\nvar _ int = \"broken\"\n\nfunc Handle() {\n\tother()\n}\n"
+	filename := filepath.Join(dir, "a.go")
+	assert.NilError(t, os.WriteFile(filename, []byte(source), 0644))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "b.go"), []byte("package main\n\nfunc other() {}\n"), 0644))
+	// helper of patch file is not injected, so injected code references an undefined function
+	brokenPatch := `package patch
+
+import gonativectx "context"
+
+func Entry(spanName string, _ bool, _ gonativectx.Context, _ ...interface{}) {
+	helper(spanName)
+}
+
+func helper(string) {}
+`
+	tests := []struct {
+		name     string
+		patch    string
+		rollback bool
+		patchErr string
+	}{
+		{name: "valid", patch: testPatchContent},
+		{name: "broken", patch: brokenPatch, patchErr: "Entry"},
+		{name: "rollback", patch: brokenPatch, rollback: true, patchErr: "Entry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := parser.ParseContent(filename, []byte(source))
+			assert.NilError(t, err)
+			opts := Options{PatchSet: newTestPatchSet(t, tt.patch), Verify: true, Rollback: tt.rollback,
+				TypeChecker: parser.NewPackageLoader().CheckFile}
+			result, err := RewriteSourceFileWithResult(&meta, opts)
+			var verifyErr *VerifyError
+			switch {
+			case tt.patchErr == "":
+				assert.NilError(t, err)
+				assert.Assert(t, string(meta.Content) != source)
+				return
+			case tt.rollback:
+				assert.NilError(t, err)
+				verifyErr = result.VerifyErr
+				assert.Equal(t, string(meta.Content), source)
+				assert.Equal(t, len(result.Funcs), 0)
+				assert.Equal(t, result.Skipped[0].SkipReason, SkipReasonRolledBack)
+			default:
+				assert.Assert(t, errors.As(err, &verifyErr))
+			}
+			assert.Equal(t, verifyErr.Patch, tt.patchErr)
+			assert.Equal(t, verifyErr.Func, "Handle")
+			assert.ErrorContains(t, verifyErr, "undefined: helper")
+		})
+	}
+}
+
+func TestVerifyRewriteSyntax(t *testing.T) {
+	original := []byte("package main\n\nfunc a() {}\n")
+	rewritten := []byte("package main\n\nfunc a() {\n\t//instrument:begin Entry\n\tx := )\n\t//instrument:end Entry\n}\n")
+	err := verifyRewrite("source.go", original, rewritten, nil)
+	var verifyErr *VerifyError
+	assert.Assert(t, errors.As(err, &verifyErr))
+	assert.Equal(t, verifyErr.Patch, "Entry")
+	assert.Equal(t, verifyErr.Func, "a")
+}
@@ -0,0 +1,67 @@
+package instrument
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/jattle/go-instrumentation/instrument/parser"
+)
+
+// sourceLoader load source file, with type information of its package if type check is enabled,
+// loader is not safe for concurrent use.
+type sourceLoader struct {
+	pkgLoader *parser.PackageLoader
+	// dir => filename => meta
+	pkgs map[string]map[string]parser.FileMeta
+	// typeChecker type check instrumented source, created on demand
+	typeChecker *parser.PackageLoader
+}
+
+func newSourceLoader(typeCheck bool) *sourceLoader {
+	loader := &sourceLoader{}
+	if typeCheck {
+		loader.pkgLoader = parser.NewPackageLoader()
+		loader.pkgs = make(map[string]map[string]parser.FileMeta)
+	}
+	return loader
+}
+
+// load source file, warnings are problems of loading type information, syntactic resolution is used instead
+func (l *sourceLoader) load(filename string) (meta parser.FileMeta, warnings []string, err error) {
+	if l.pkgLoader == nil {
+		meta, err = parser.ParseFile(filename)
+		return
+	}
+	filename = filepath.Clean(filename)
+	dir := filepath.Dir(filename)
+	metas, ok := l.pkgs[dir]
+	if !ok {
+		pkgMetas, err := l.pkgLoader.LoadDir(dir)
+		if err != nil {
+			// type errors only make context detection fall back to syntactic resolution
+			warnings = append(warnings, fmt.Sprintf("load types of dir %s failed, err: %+v", dir, err))
+		}
+		metas = make(map[string]parser.FileMeta, len(pkgMetas))
+		for _, meta := range pkgMetas {
+			metas[filepath.Clean(meta.FileName)] = meta
+		}
+		l.pkgs[dir] = metas
+	}
+	if meta, ok := metas[filename]; ok {
+		return meta, warnings, nil
+	}
+	// file excluded by build constraints, parse it without types
+	meta, err = parser.ParseFile(filename)
+	return meta, warnings, err
+}
+
+// checker package loader type checking instrumented source, imported packages are shared with type loading
+func (l *sourceLoader) checker() *parser.PackageLoader {
+	if l.typeChecker == nil {
+		l.typeChecker = l.pkgLoader
+		if l.typeChecker == nil {
+			l.typeChecker = parser.NewPackageLoader()
+		}
+	}
+	return l.typeChecker
+}
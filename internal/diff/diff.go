@@ -0,0 +1,235 @@
+// Package diff generate unified diff of two contents by lines, using myers diff algorithm.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const contextLines = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// op one line of edit script, oldLine and newLine are line indexes in old and new content
+type op struct {
+	kind             opKind
+	oldLine, newLine int
+}
+
+// Unified generate unified diff of old and new content, nil returned if both are equal
+func Unified(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	a, b := splitLines(old), splitLines(new)
+	ops := editScript(a, b)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks(ops) {
+		writeHunk(&buf, a, b, ops[h[0]:h[1]])
+	}
+	return buf.Bytes()
+}
+
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i == -1 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// editScript shortest edit script from a to b
+func editScript(a, b []string) []op {
+	n, m := len(a), len(b)
+	// trim common prefix and suffix, most of times only a few lines are changed
+	prefix := 0
+	for prefix < n && prefix < m && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < n-prefix && suffix < m-prefix && a[n-1-suffix] == b[m-1-suffix] {
+		suffix++
+	}
+	ops := make([]op, 0, n+m)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, op{kind: opEqual, oldLine: i, newLine: i})
+	}
+	for _, o := range myers(a[prefix:n-suffix], b[prefix:m-suffix]) {
+		o.oldLine += prefix
+		o.newLine += prefix
+		ops = append(ops, o)
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, op{kind: opEqual, oldLine: n - suffix + i, newLine: m - suffix + i})
+	}
+	return ops
+}
+
+// myers find shortest edit script, trace of every step d only keeps diagonals in [-d, d]
+func myers(a, b []string) []op {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD == 0 {
+		return nil
+	}
+	// v[k+maxD] is the furthest x of diagonal k
+	v := make([]int, 2*maxD+2)
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+maxD] < v[k+1+maxD]) {
+				x = v[k+1+maxD]
+			} else {
+				x = v[k-1+maxD] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+maxD] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int{}, v[maxD-d:maxD+d+1]...))
+				return backtrack(trace, n, m)
+			}
+		}
+		trace = append(trace, append([]int{}, v[maxD-d:maxD+d+1]...))
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, n, m int) []op {
+	// get furthest x of diagonal k at step d
+	furthest := func(d, k int) int {
+		return trace[d][k+d]
+	}
+	x, y := n, m
+	ops := make([]op, 0, n+m)
+	for d := len(trace) - 1; d > 0; d-- {
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && furthest(d-1, k-1) < furthest(d-1, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := furthest(d-1, prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{kind: opEqual, oldLine: x, newLine: y})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, op{kind: opInsert, oldLine: x, newLine: y})
+		} else {
+			x--
+			ops = append(ops, op{kind: opDelete, oldLine: x, newLine: y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, op{kind: opEqual, oldLine: x, newLine: y})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// hunks split edit script into hunks with context lines, every hunk is range [begin, end) of ops
+func hunks(ops []op) [][2]int {
+	var rets [][2]int
+	for i := 0; i < len(ops); {
+		if ops[i].kind == opEqual {
+			i++
+			continue
+		}
+		begin := max(i-contextLines, 0)
+		// extend hunk until there are more than 2*contextLines equal lines
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != opEqual {
+				end++
+				continue
+			}
+			equal := end
+			for equal < len(ops) && ops[equal].kind == opEqual {
+				equal++
+			}
+			if equal == len(ops) || equal-end > 2*contextLines {
+				end = min(end+contextLines, len(ops))
+				break
+			}
+			end = equal
+		}
+		if len(rets) > 0 && rets[len(rets)-1][1] >= begin {
+			rets[len(rets)-1][1] = end
+		} else {
+			rets = append(rets, [2]int{begin, end})
+		}
+		i = end
+	}
+	return rets
+}
+
+func writeHunk(buf *bytes.Buffer, a, b []string, ops []op) {
+	var oldCount, newCount int
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			oldCount++
+			newCount++
+		case opDelete:
+			oldCount++
+		case opInsert:
+			newCount++
+		}
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(ops[0].oldLine, oldCount), hunkRange(ops[0].newLine, newCount))
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			writeLine(buf, ' ', a[o.oldLine])
+		case opDelete:
+			writeLine(buf, '-', a[o.oldLine])
+		case opInsert:
+			writeLine(buf, '+', b[o.newLine])
+		}
+	}
+}
+
+// hunkRange line numbers start from 1, start line of empty range is the line before it
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func writeLine(buf *bytes.Buffer, prefix byte, line string) {
+	buf.WriteByte(prefix)
+	buf.WriteString(line)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		buf.WriteString("\n\\ No newline at end of file\n")
+	}
+}
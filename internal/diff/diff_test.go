@@ -0,0 +1,46 @@
+package diff
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestUnified(t *testing.T) {
+	cases := []struct {
+		name     string
+		old, new string
+		expected string
+	}{
+		{
+			name:     "equal",
+			old:      "a\nb\n",
+			new:      "a\nb\n",
+			expected: "",
+		},
+		{
+			name:     "insert",
+			old:      "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			new:      "1\n2\n3\n4\n5\nx\n6\n7\n8\n9\n",
+			expected: "--- a.go\n+++ b.go\n@@ -3,6 +3,7 @@\n 3\n 4\n 5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			name: "two-hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+			new:  "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			expected: "--- a.go\n+++ b.go\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n" +
+				"@@ -8,4 +9,3 @@\n 8\n 9\n 10\n-11\n",
+		},
+		{
+			name:     "no-newline-at-end",
+			old:      "a\nb",
+			new:      "a\nc",
+			expected: "--- a.go\n+++ b.go\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, string(Unified("a.go", "b.go", []byte(c.old), []byte(c.new))), c.expected)
+		})
+	}
+}
@@ -3,10 +3,12 @@ package astvisitor
 import (
 	"fmt"
 	"go/ast"
+	"hash/fnv"
 	"path"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 var (
@@ -28,10 +30,39 @@ func GenVarSuffix(patch string) string {
 	return ToValidVarName(prefix)
 }
 
+// GenHashVarSuffix gen deterministic var suffix by hash of patch file path and patch function name, patch should be
+// full path or import path of patch file, so patch files with the same name in different dirs get different suffixes,
+// salt is used to generate another suffix when the default one(salt 0) conflicts
+func GenHashVarSuffix(patch, funcName string, salt int) string {
+	h := fnv.New32a()
+	h.Write([]byte(patch + "." + funcName))
+	if salt > 0 {
+		fmt.Fprintf(h, "#%d", salt)
+	}
+	return ToValidVarName(fmt.Sprintf("%s%08x", BaseName(patch), h.Sum32()))
+}
+
+// CollectIdentNames collect names of all identifiers in node, identifiers are ignored if skip returns true
+func CollectIdentNames(node ast.Node, skip func(*ast.Ident) bool) map[string]struct{} {
+	m := make(map[string]struct{})
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && (skip == nil || !skip(ident)) {
+			m[ident.Name] = struct{}{}
+		}
+		return true
+	})
+	return m
+}
+
 // ToValidVarName to valid var name
 func ToValidVarName(v string) string {
-	// remove _
-	return strings.ReplaceAll(v, "_", "")
+	// remove _ and other chars which are not letter or digit, eg: - in file name
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, v)
 }
 
 // CollectFuncVars collect function params var names and function body declared var names
@@ -53,6 +84,18 @@ func CollectFuncVars(funcDecl *ast.FuncDecl) (map[string]struct{}, error) {
 	return m, nil
 }
 
+// CollectFuncLabels collect label names of function body, labels of nested function literals are included
+func CollectFuncLabels(funcDecl *ast.FuncDecl) map[string]struct{} {
+	m := make(map[string]struct{})
+	ast.Inspect(funcDecl, func(node ast.Node) bool {
+		if n, ok := node.(*ast.LabeledStmt); ok {
+			m[n.Label.Name] = struct{}{}
+		}
+		return true
+	})
+	return m
+}
+
 func collectNodeVars(n ast.Node, m map[string]struct{}) {
 	v := varVistor{}
 	ast.Walk(&v, n)
@@ -69,13 +112,15 @@ type varVistor struct {
 	vars []string
 }
 
-// Visit collect declared vars
+// Visit collect declared vars, fields of struct types are not vars, eg: fields of func descriptor param
 func (f *varVistor) Visit(node ast.Node) ast.Visitor {
 	switch n := node.(type) {
 	case *ast.Ident:
 		if n.Obj != nil && n.Obj.Kind == ast.Var {
 			f.vars = append(f.vars, n.Name)
 		}
+	case *ast.StructType:
+		return nil
 	}
 	return f
 }
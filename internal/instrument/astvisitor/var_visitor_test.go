@@ -49,3 +49,41 @@ func ProcessFunc(spanName string, hasCtx bool, ctx context.Context, args ...inte
 		assert.Equal(t, ok, true)
 	}
 }
+
+func TestCollectFuncVarsStructFields(t *testing.T) {
+	content := `
+package main
+
+import "fmt"
+
+func ProcessFunc(fn *struct {
+	Func string
+	Line int
+}) {
+	s := struct{ Name string }{Name: fn.Func}
+	fmt.Println(s.Name, fn.Line)
+}
+	`
+	f, err := parser.ParseContent("example.go", []byte(content))
+	assert.NilError(t, err)
+	m, err := CollectFuncVars(f.ASTFile.Decls[1].(*ast.FuncDecl))
+	assert.NilError(t, err)
+	// fields of struct types are not vars
+	assert.Equal(t, len(m), 2)
+	for _, n := range []string{"fn", "s"} {
+		_, ok := m[n]
+		assert.Assert(t, ok, n)
+	}
+}
+
+func TestGenHashVarSuffix(t *testing.T) {
+	suffix := GenHashVarSuffix("a/b/instrument_go_trace.go", "InstrumentGoTrace", 0)
+	assert.Equal(t, suffix, "instrumentgotraceb1599826")
+	// deterministic
+	assert.Equal(t, GenHashVarSuffix("a/b/instrument_go_trace.go", "InstrumentGoTrace", 0), suffix)
+	// patch files with the same name in different dirs
+	assert.Assert(t, GenHashVarSuffix("c/instrument_go_trace.go", "InstrumentGoTrace", 0) != suffix)
+	assert.Assert(t, GenHashVarSuffix("a/b/instrument_go_trace.go", "InstrumentGoTrace", 1) != suffix)
+	assert.Assert(t, GenHashVarSuffix("a/b/instrument_go_trace.go", "Other", 0) != suffix)
+	assert.Equal(t, ToValidVarName("my-patch_v2.x"), "mypatchv2x")
+}